@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	middleware "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/middleware"
+	storage "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/storage"
+	urlnorm "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/urlnorm"
+)
+
+func TestPlanMatchesImport(t *testing.T) {
+	ctx := context.Background()
+	expired := time.Now().Add(-time.Hour).Unix()
+
+	dst := backend{name: "target", storage: storage.NewMemory("")}
+	require.NoError(t, dst.storage.Import(ctx, []middleware.JSONStruct{
+		{FullURL: "https://deleted.example/", ShortenURL: 1, User: "u1", Deleted: true},
+		{FullURL: "https://expired.example/", ShortenURL: 2, User: "u1", ExpiresAt: expired},
+		{FullURL: "https://live.example/", ShortenURL: 3, User: "u1"},
+	}))
+
+	src := backend{name: "source", storage: storage.NewMemory("")}
+	require.NoError(t, src.storage.Import(ctx, []middleware.JSONStruct{
+		{FullURL: "https://deleted.example/", ShortenURL: 11, User: "u2"},
+		{FullURL: "https://expired.example/", ShortenURL: 12, User: "u2"},
+		{FullURL: "https://live.example/", ShortenURL: 13, User: "u2", Deleted: true},
+	}))
+
+	// urls of dead links are free on both sides
+	require.NoError(t, plan(ctx, src, dst))
+	require.NoError(t, copyRecords(ctx, src, dst, 10))
+
+	conflicting := backend{name: "source", storage: storage.NewMemory("")}
+	require.NoError(t, conflicting.storage.Import(ctx, []middleware.JSONStruct{
+		{FullURL: "https://live.example/", ShortenURL: 21, User: "u2"},
+	}))
+	assert.Error(t, plan(ctx, conflicting, dst))
+	assert.Error(t, copyRecords(ctx, conflicting, dst, 10))
+}
+
+func TestCopyAllMovesClicksAndKeys(t *testing.T) {
+	ctx := context.Background()
+	at := time.Date(2022, 12, 11, 23, 15, 0, 0, time.UTC)
+
+	src := backend{name: "source", storage: storage.NewMemory("")}
+	require.NoError(t, src.storage.Import(ctx, []middleware.JSONStruct{
+		{FullURL: "https://github.com/", ShortenURL: 1, User: "u1"},
+	}))
+	require.NoError(t, src.storage.AddClicks(ctx, []storage.Click{{Code: "1", Time: at}, {Code: "1", Time: at.Add(time.Hour)}}))
+	require.NoError(t, src.storage.AddAPIKey(ctx, storage.APIKey{ID: "k1", User: "u1", Hash: "h1", CreatedAt: at}))
+
+	dst := backend{name: "target", storage: storage.NewMemory("")}
+	require.NoError(t, plan(ctx, src, dst))
+	require.NoError(t, copyAll(ctx, src, dst, 1))
+	require.NoError(t, copyAll(ctx, src, dst, 1), "a repeated copy must not count clicks twice")
+
+	mismatches, err := verifyAll(ctx, src, dst)
+	require.NoError(t, err)
+	assert.Equal(t, 0, mismatches)
+
+	stats, err := dst.storage.LinkStats(ctx, "1", "u1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), stats.Clicks)
+	assert.Len(t, stats.Daily, 2)
+	user, err := dst.storage.UserByAPIKey(ctx, "h1")
+	require.NoError(t, err)
+	assert.Equal(t, "u1", user)
+}
+
+func TestNormalizeURLs(t *testing.T) {
+	ctx := context.Background()
+	dst := backend{name: "target", storage: storage.NewMemory("")}
+	require.NoError(t, dst.storage.Import(ctx, []middleware.JSONStruct{
+		{FullURL: "HTTPS://GitHub.com:443/?b=2&a=1", ShortenURL: 1, User: "u1"},
+	}))
+
+	require.NoError(t, normalizeURLs(ctx, dst, urlnorm.Normalizer{SortQuery: true}))
+	url, err := dst.storage.SearchURL(ctx, "1")
+	require.NoError(t, err)
+	assert.Equal(t, "https://github.com/?a=1&b=2", url)
+}
@@ -2,26 +2,191 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
 	"flag"
+	"fmt"
 	_ "github.com/jackc/pgx/v4/stdlib"
 	_ "github.com/lib/pq"
 	"github.com/pressly/goose/v3"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	auth "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/auth"
 	handlers "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/handlers"
 	middleware "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/middleware"
+	policy "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/policy"
 	storage "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/storage"
+	tlsconfig "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/tlsconfig"
+	urlnorm "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/urlnorm"
 )
 
 const (
-	command = "up"
-	dir     = "internal/migrations"
+	command   = "up"
+	dir       = "internal/migrations"
+	sqliteDir = "internal/migrations/sqlite"
+
+	deleteWorkers       = 4
+	deleteBatchSize     = 100
+	deleteFlushInterval = time.Second
+
+	defaultDBTimeout = 5 * time.Second
+
+	defaultFileSyncInterval    = time.Second
+	defaultFileCompactInterval = 10 * time.Minute
+
+	defaultExpireInterval = time.Minute
+
+	defaultPolicyInterval = 10 * time.Second
+
+	defaultShutdownTimeout = 10 * time.Second
+
+	selfSignedValidity = 30 * 24 * time.Hour
+
+	defaultWriteLimit    = "600/m"
+	defaultRedirectLimit = "6000/m"
+
+	clickBufferSize    = 10000
+	clickBatchSize     = 500
+	clickFlushInterval = time.Second
+
+	defaultIDGenerator = "random"
+	defaultIDLength    = 8
 )
 
+// errDBUnreachable is a migration failure the service starts despite, /ping
+// reports it. Any other one stops the service.
+var errDBUnreachable = errors.New("DB is unreachable")
+
+func migrate(connStr string, migrationsDir string) error {
+	db, err := goose.OpenDBWithDriver("pgx", connStr)
+	if err != nil {
+		return fmt.Errorf("failed to open DB: %w", err)
+	}
+	defer db.Close()
+
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("%w: %v", errDBUnreachable, err)
+	}
+	if err := goose.Run(command, db, migrationsDir); err != nil {
+		return fmt.Errorf("goose %v: %w", command, err)
+	}
+	log.Println("Success migration!")
+	return nil
+}
+
+func envString(key string, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	if value, ok := os.LookupEnv(key); ok {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("%s must be a duration like 5s: %v", key, err)
+		}
+		return d
+	}
+	return fallback
+}
+
+func envInt(key string, fallback int) int {
+	if value, ok := os.LookupEnv(key); ok {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			log.Fatalf("%s must be an integer: %v", key, err)
+		}
+		return n
+	}
+	return fallback
+}
+
+func envBool(key string, fallback bool) bool {
+	if value, ok := os.LookupEnv(key); ok {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Fatalf("%s must be true or false: %v", key, err)
+		}
+		return b
+	}
+	return fallback
+}
+
+// loadKeys reads JWT keys from file or, without one, from keys. With neither
+// a random key is made and every restart signs all users out.
+func loadKeys(file string, keys string, method string, ttl time.Duration) (*auth.Keys, error) {
+	if file != "" {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read JWT keys: %w", err)
+		}
+		keys = string(content)
+	}
+	if keys == "" {
+		log.Println("WARNING: no JWT keys given, tokens will not survive a restart.")
+		return auth.RandomKeys(ttl)
+	}
+	return auth.ParseKeys(keys, method, ttl)
+}
+
+// defaultAddresses fills in whichever of server and baseURL is not given,
+// short links lead to the server itself by default.
+func defaultAddresses(server string, baseURL string, https bool) (string, string) {
+	if server == "" {
+		server = "localhost:8080"
+	}
+	if baseURL == "" {
+		scheme := "http://"
+		if https {
+			scheme = "https://"
+		}
+		baseURL = scheme + server + "/"
+	}
+	return server, baseURL
+}
+
+// minHashKeyLength keeps the client address hashes from being brute forced
+// over the small space of IPv4 addresses.
+const minHashKeyLength = 16
+
+// loadHashKey reads the key of client address hashes from file or takes key,
+// so the hashes of a visitor stay the same across restarts.
+func loadHashKey(file string, key string) ([]byte, error) {
+	if file != "" {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read IP hash key: %w", err)
+		}
+		key = strings.TrimSpace(string(content))
+	}
+	if key == "" {
+		log.Println("WARNING: no IP hash key given, client hashes will change after a restart.")
+		return middleware.GenerateRandom(minHashKeyLength), nil
+	}
+	if len(key) < minHashKeyLength {
+		return nil, fmt.Errorf("IP hash key is shorter than %d bytes", minHashKeyLength)
+	}
+	return []byte(key), nil
+}
+
 func main() {
+	os.Exit(run())
+}
+
+// run starts the service and blocks until it is stopped. It returns the exit
+// code instead of exiting, so deferred cleanup runs on errors as well.
+func run() int {
 	var (
 		st       storage.Storage
 		err      error
@@ -29,14 +194,57 @@ func main() {
 		baseURL  = flag.String("b", os.Getenv("BASE_URL"), "base URL")
 		filePath = flag.String("f", os.Getenv("FILE_STORAGE_PATH"), "server address")
 		connStr  = flag.String("d", os.Getenv("DATABASE_DSN"), "connection url for DB")
+		timeout  = flag.Duration("dt", envDuration("DATABASE_TIMEOUT", defaultDBTimeout), "timeout for a single DB operation")
+
+		fileSync            = flag.String("fs", envString("FILE_STORAGE_SYNC", string(storage.SyncInterval)), "fsync policy for file: always, interval or never")
+		fileSyncInterval    = flag.Duration("fsi", envDuration("FILE_STORAGE_SYNC_INTERVAL", defaultFileSyncInterval), "fsync interval for file with interval policy")
+		fileCompactInterval = flag.Duration("fci", envDuration("FILE_STORAGE_COMPACT_INTERVAL", defaultFileCompactInterval), "how often file is checked for compaction, 0 to disable")
+
+		idGenerator = flag.String("g", envString("ID_GENERATOR", defaultIDGenerator), "short code generator: decimal, base62, random or hashids")
+		idLength    = flag.Int("gl", envInt("ID_LENGTH", defaultIDLength), "length of random codes, minimal length of hashids codes")
+		idSalt      = flag.String("gs", os.Getenv("ID_SALT"), "salt of hashids codes")
+
+		expireInterval = flag.Duration("ei", envDuration("EXPIRE_INTERVAL", defaultExpireInterval), "how often expired links are marked as deleted, 0 to disable")
+
+		maxBodySize    = flag.Int("ml", envInt("MAX_BODY_SIZE", middleware.DefaultMaxBodySize), "largest request body in bytes as sent")
+		maxDecodedSize = flag.Int("md", envInt("MAX_DECODED_BODY_SIZE", middleware.DefaultMaxDecodedSize), "largest request body in bytes after gzip is decoded")
+		maxBatchSize   = flag.Int("mb", envInt("MAX_BATCH_SIZE", middleware.DefaultMaxBatchSize), "most URLs in one /api/shorten/batch request")
+
+		urlKeepPort      = flag.Bool("up", envBool("URL_KEEP_DEFAULT_PORT", false), "keep :80 and :443 in stored URLs")
+		urlStripFragment = flag.Bool("uf", envBool("URL_STRIP_FRAGMENT", false), "drop #fragment from stored URLs")
+		urlSortQuery     = flag.Bool("uq", envBool("URL_SORT_QUERY", false), "sort query parameters of stored URLs by name")
+
+		policyFile     = flag.String("p", os.Getenv("POLICY_FILE"), "file with allow and block rules for shortened hosts, empty to allow all")
+		policyInterval = flag.Duration("pi", envDuration("POLICY_RELOAD_INTERVAL", defaultPolicyInterval), "how often the policy file is checked for changes, 0 to disable")
+
+		writeLimit    = flag.String("rw", envString("RATE_LIMIT_WRITES", defaultWriteLimit), "requests making links per user and per address, like 60/m or 10/s,50; 0 to disable")
+		redirectLimit = flag.String("rr", envString("RATE_LIMIT_REDIRECTS", defaultRedirectLimit), "redirects per user and per address, like 600/m; 0 to disable")
+		limitRealIP   = flag.Bool("ri", envBool("RATE_LIMIT_REAL_IP", false), "limit by X-Real-IP, set it behind a proxy that sets the header, else all clients share the proxy address")
+
+		enableHTTPS = flag.Bool("s", envBool("ENABLE_HTTPS", false), "serve HTTPS with HTTP/2 instead of HTTP")
+		certFile    = flag.String("sc", os.Getenv("TLS_CERT_FILE"), "PEM certificate chain for HTTPS")
+		keyFile     = flag.String("sk", os.Getenv("TLS_KEY_FILE"), "PEM private key for HTTPS")
+		selfSigned  = flag.Bool("ss", envBool("TLS_SELF_SIGNED", false), "make a self-signed certificate for the SERVER_ADDRESS host on start, for development only")
+
+		shutdownTimeout = flag.Duration("st", envDuration("SHUTDOWN_TIMEOUT", defaultShutdownTimeout), "how long requests in progress may run after SIGINT, SIGTERM or SIGQUIT")
+
+		trustedSubnet = flag.String("t", os.Getenv("TRUSTED_SUBNET"), "CIDR of the subnet allowed to use /api/internal, empty to deny everyone")
+
+		jwtKeyFile = flag.String("k", os.Getenv("JWT_KEY_FILE"), "file with JWT keys as kid=secret per line, the first one signs; JWT_KEYS holds them comma separated instead")
+		jwtMethod  = flag.String("jm", envString("JWT_METHOD", auth.DefaultMethod), "JWT signing method: HS256, HS384 or HS512")
+		jwtTTL     = flag.Duration("jt", envDuration("JWT_TTL", auth.DefaultTTL), "lifetime of issued JWTs")
+
+		hashKeyFile = flag.String("hk", os.Getenv("IP_HASH_KEY_FILE"), "file with the key of client address hashes in click stats; IP_HASH_KEY holds it instead")
 	)
 	flag.Parse()
 
-	if *server == "" || *baseURL == "" {
-		*server = "localhost:8080"
-		*baseURL = "http://" + *server + "/"
+	ids, err := storage.NewIDGenerator(*idGenerator, *idLength, *idSalt)
+	if err != nil {
+		log.Fatal(err)
 	}
 
+	*server, *baseURL = defaultAddresses(*server, *baseURL, *enableHTTPS)
+
 	if len(strings.Split(*server, ":")) != 2 {
 		log.Fatal("Need address in a form host:port")
 	}
@@ -45,90 +253,226 @@ func main() {
 		*baseURL = *baseURL + "/"
 	}
 
+	var cert tls.Certificate
+	switch {
+	case !*enableHTTPS:
+		if *certFile != "" || *keyFile != "" || *selfSigned {
+			log.Println("WARNING: TLS options are ignored without ENABLE_HTTPS.")
+		}
+	case *selfSigned:
+		if *certFile != "" || *keyFile != "" {
+			log.Fatal("TLS_SELF_SIGNED and TLS_CERT_FILE exclude each other")
+		}
+		cert, err = tlsconfig.SelfSigned(strings.Split(*server, ":")[0], selfSignedValidity)
+		if err != nil {
+			log.Fatalf("failed to make a self-signed certificate: %v", err)
+		}
+		log.Printf("WARNING: serving a self-signed certificate, SHA-256 fingerprint %X.", sha256.Sum256(cert.Certificate[0]))
+	case *certFile == "" || *keyFile == "":
+		log.Fatal("ENABLE_HTTPS needs TLS_CERT_FILE and TLS_KEY_FILE, or TLS_SELF_SIGNED for development")
+	default:
+		cert, err = tlsconfig.Load(*certFile, *keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	keys, err := loadKeys(*jwtKeyFile, os.Getenv("JWT_KEYS"), *jwtMethod, *jwtTTL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	hashKey, err := loadHashKey(*hashKeyFile, os.Getenv("IP_HASH_KEY"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	mwItem := &middleware.MiddlewareStruct{
-		SecretKey: middleware.SecretKey,
+		SecretKey: hashKey,
+		Keys:      keys,
 		BaseURL:   *baseURL,
 		Server:    *server,
+		// browsers must not send the token over plain HTTP
+		SecureCookies: *enableHTTPS,
+		Limits: middleware.BodyLimits{
+			MaxBodySize:    int64(*maxBodySize),
+			MaxDecodedSize: int64(*maxDecodedSize),
+			MaxBatchSize:   *maxBatchSize,
+		},
+		URLs: urlnorm.Normalizer{
+			KeepDefaultPort: *urlKeepPort,
+			StripFragment:   *urlStripFragment,
+			SortQuery:       *urlSortQuery,
+		},
+	}
+	writes, err := middleware.ParseRateLimit(*writeLimit)
+	if err != nil {
+		log.Fatalf("RATE_LIMIT_WRITES: %v", err)
+	}
+	redirects, err := middleware.ParseRateLimit(*redirectLimit)
+	if err != nil {
+		log.Fatalf("RATE_LIMIT_REDIRECTS: %v", err)
+	}
+	mwItem.WriteLimit = middleware.NewRateLimiter(writes, *limitRealIP)
+	mwItem.RedirectLimit = middleware.NewRateLimiter(redirects, *limitRealIP)
+	if (mwItem.WriteLimit != nil || mwItem.RedirectLimit != nil) && !*limitRealIP {
+		log.Println("WARNING: rate limits count clients by the address connected to the server. " +
+			"Behind a proxy all clients share its address, set RATE_LIMIT_REAL_IP=true there.")
+	}
+
+	if *policyFile != "" {
+		engine, err := policy.NewEngine(*policyFile, *policyInterval)
+		if err != nil {
+			log.Fatalf("failed to load policy: %v", err)
+		}
+		// from here on errors return, so that what is deferred is closed
+		defer engine.Close()
+		mwItem.Policy = engine
+	}
+	if *trustedSubnet != "" {
+		_, subnet, err := net.ParseCIDR(*trustedSubnet)
+		if err != nil {
+			log.Printf("TRUSTED_SUBNET must be a CIDR like 192.168.0.0/24: %v", err)
+			return 1
+		}
+		mwItem.TrustedSubnet = subnet
 	}
 
-	if *connStr != "" {
+	if sqliteDSN, ok := storage.SQLiteDSN(*connStr); ok {
+		log.Println("WARNING: saving will be done through SQLite.")
+
+		sqliteItem, err := storage.NewSQLite(*baseURL, sqliteDSN, *timeout)
+		if err != nil {
+			log.Printf("failed to open SQLite: %v", err)
+			return 1
+		}
+		sqliteItem.IDs = ids
+
+		if err := sqliteItem.Migrate(sqliteDir); err != nil {
+			sqliteItem.Close()
+			log.Printf("goose %v: %v", command, err)
+			return 1
+		}
+		log.Println("Success migration!")
+		st = storage.Storage(sqliteItem)
+
+	} else if *connStr != "" {
 		log.Println("WARNING: saving will be done through DataBase.")
 
 		DBItem := &storage.Database{
 			BaseURL:   *baseURL,
+			IDs:       ids,
 			DBConnURL: *connStr,
-			CTX:       context.Background(),
+			Timeout:   *timeout,
 		}
 		var dbErrorConnect error
 
-		pool, err := DBItem.GetDBConnection()
-
-		if err != nil {
+		// statements are prepared on every new connection, so the schema
+		// has to be migrated before the pool is created
+		if err := migrate(*connStr, dir); errors.Is(err, errDBUnreachable) {
 			log.Println(err)
 			dbErrorConnect = err
-		}
-
-		defer pool.Close()
-
-		DBItem.ConnPool = pool
-		DBItem.DBErrorConnect = dbErrorConnect
-
-		if DBItem.DBErrorConnect == nil {
-			db, err := goose.OpenDBWithDriver("pgx", *connStr)
+		} else if err != nil {
+			log.Println(err)
+			return 1
+		} else {
+			pool, err := DBItem.GetDBConnection(context.Background())
 			if err != nil {
-				log.Fatalf("failed to open DB: %v\n", err)
-			}
-
-			defer func() {
-				if err := db.Close(); err != nil {
-					log.Fatalf("failed to close DB: %v\n", err)
-				}
-			}()
-
-			if err := goose.Run(command, db, dir); err != nil {
-				log.Fatalf("goose %v: %v", command, err)
+				log.Println(err)
+				dbErrorConnect = err
 			} else {
-				log.Println("Success migration!")
+				DBItem.ConnPool = pool
 			}
 		}
+		DBItem.DBErrorConnect = dbErrorConnect
+
 		st = storage.Storage(DBItem)
 
 	} else if *connStr == "" && *filePath != "" {
 		log.Println("WARNING: saving will be done through file.")
 
-		fileItem := &storage.File{
-			BaseURL:  *baseURL,
-			Filepath: *filePath,
-			ID:       0,
-			URLID:    make(map[string]int),
-			IDURL:    make(map[int]string),
-			UserURLs: make(map[string][]int),
+		policy, err := storage.ParseSyncPolicy(*fileSync)
+		if err != nil {
+			log.Println(err)
+			return 1
 		}
 
-		if _, err := os.Stat(*filePath); os.IsNotExist(err) {
-			middleware.CreateFile(*filePath)
-		} else {
-			targets := middleware.InitMapByJSON(*filePath)
-			fileItem.NewFromFile(*baseURL, targets)
+		fileItem, err := storage.NewFile(*baseURL, *filePath, storage.FileConfig{
+			Sync:            policy,
+			SyncInterval:    *fileSyncInterval,
+			CompactInterval: *fileCompactInterval,
+		})
+		if err != nil {
+			log.Println(err)
+			return 1
 		}
+		fileItem.IDs = ids
+
 		st = storage.Storage(fileItem)
 
 	} else if *connStr == "" && *filePath == "" {
 		log.Println("WARNING: saving will be done through memory.")
-		memoryItem := &storage.Memory{
-			BaseURL:  *baseURL,
-			ID:       0,
-			URLID:    make(map[string]int),
-			IDURL:    make(map[int]string),
-			UserURLs: make(map[string][]int),
-		}
+		memoryItem := storage.NewMemory(*baseURL)
+		memoryItem.IDs = ids
 
 		st = storage.Storage(memoryItem)
 	}
 
-	if err = http.ListenAndServe(":"+strings.Split(*server, ":")[1],
-		handlers.NewRouter(st, *mwItem)); err != http.ErrServerClosed {
-		log.Fatalf("HTTP server ListenAndServe Error: %v", err)
+	// deferred calls run in reverse: workers writing to storage are drained
+	// before it is closed
+	defer func() {
+		if err := st.Close(); err != nil {
+			log.Println("unable to close storage", err)
+		}
+	}()
+
+	deleter := storage.NewDeleter(st, deleteWorkers, deleteBatchSize, deleteFlushInterval)
+	defer deleter.Close()
+
+	clicks := storage.NewClickRecorder(st, clickBufferSize, clickBatchSize, clickFlushInterval)
+	defer clicks.Close()
+
+	if *expireInterval > 0 {
+		janitor := storage.NewJanitor(st, *expireInterval)
+		defer janitor.Close()
+	}
+
+	srv := &http.Server{
+		Addr:    ":" + strings.Split(*server, ":")[1],
+		Handler: handlers.NewRouter(st, deleter, clicks, *mwItem),
+	}
+	if *enableHTTPS {
+		srv.TLSConfig = tlsconfig.New(cert)
 	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			// the certificate is in TLSConfig already
+			serveErr <- srv.ListenAndServeTLS("", "")
+		} else {
+			serveErr <- srv.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-serveErr:
+		// the server did not start, there are no requests to drain, but
+		// workers and storage are closed by the deferred calls
+		log.Printf("HTTP server ListenAndServe Error: %v", err)
+		return 1
+	case <-ctx.Done():
+		// a second signal kills the process without waiting
+		stop()
+		log.Printf("shutting down, waiting up to %v for requests in progress", *shutdownTimeout)
 
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("requests in progress are cut off: %v", err)
+		}
+	}
+	return 0
 }
@@ -0,0 +1,29 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// APIKeyPrefix makes API keys easy to tell from tokens and to find in leaked
+// logs or configs.
+const APIKeyPrefix = "sk_"
+
+// NewAPIKey makes a key and the public ID it is listed and deleted by. Only
+// the key owner ever sees the key itself, storages keep its HashAPIKey.
+func NewAPIKey() (id string, key string, err error) {
+	buf := make([]byte, 8+32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(buf[:8]), APIKeyPrefix + hex.EncodeToString(buf[8:]), nil
+}
+
+// HashAPIKey returns the hash API keys are stored and looked up by. Keys are
+// 256 random bits, so a fast hash is enough: there is nothing to brute force.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(key)))
+	return hex.EncodeToString(sum[:])
+}
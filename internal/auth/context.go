@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+)
+
+// userKey is unexported, so only this package can put a user into a context
+// and every user found there was verified by it.
+type userKey struct{}
+
+// tokenKey marks a token issued while the request was served.
+type tokenKey struct{}
+
+// WithUser returns ctx carrying the verified user.
+func WithUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// UserFromContext returns the user of the request and whether it has one.
+func UserFromContext(ctx context.Context) (string, bool) {
+	user, ok := ctx.Value(userKey{}).(string)
+	return user, ok && user != ""
+}
+
+// WithToken returns ctx carrying the token just issued to its user.
+func WithToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, tokenKey{}, token)
+}
+
+// TokenFromContext returns the token issued to the user of the request while
+// it was served, if any.
+func TokenFromContext(ctx context.Context) (string, bool) {
+	token, ok := ctx.Value(tokenKey{}).(string)
+	return token, ok && token != ""
+}
+
+// RequireUser answers 401 to requests without a verified user instead of
+// giving them a new one, for endpoints that make no sense for a new user.
+func RequireUser(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if _, ok := UserFromContext(r.Context()); !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
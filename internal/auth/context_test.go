@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserFromContext(t *testing.T) {
+	_, ok := UserFromContext(context.Background())
+	assert.False(t, ok)
+
+	_, ok = UserFromContext(WithUser(context.Background(), ""))
+	assert.False(t, ok, "an empty user is no user")
+
+	// a plain string key can not pass for a verified user
+	_, ok = UserFromContext(context.WithValue(context.Background(), "user", "u1"))
+	assert.False(t, ok)
+
+	user, ok := UserFromContext(WithUser(context.Background(), "u1"))
+	assert.True(t, ok)
+	assert.Equal(t, "u1", user)
+}
+
+func TestTokenFromContext(t *testing.T) {
+	_, ok := TokenFromContext(WithUser(context.Background(), "u1"))
+	assert.False(t, ok)
+
+	token, ok := TokenFromContext(WithToken(context.Background(), "t1"))
+	assert.True(t, ok)
+	assert.Equal(t, "t1", token)
+}
+
+func TestRequireUser(t *testing.T) {
+	handler := RequireUser(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := UserFromContext(r.Context())
+		w.Write([]byte(user))
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/user/urls", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "Bearer", w.Header().Get("WWW-Authenticate"))
+	assert.Empty(t, w.Header().Values("Set-Cookie"))
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/api/user/urls", nil)
+	handler.ServeHTTP(w, r.WithContext(WithUser(r.Context(), "u1")))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "u1", w.Body.String())
+}
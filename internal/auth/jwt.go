@@ -0,0 +1,140 @@
+// Package auth issues and verifies the tokens users of the service are
+// identified by.
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	DefaultMethod = "HS256"
+	DefaultTTL    = 30 * 24 * time.Hour
+
+	// minSecretLength is the length of a random HS256 key, shorter secrets
+	// are too easy to brute force from a single token.
+	minSecretLength = 32
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrUnknownKey   = errors.New("token is signed with an unknown key")
+)
+
+// Claims of a token: the user it was issued to, issue time and expiry.
+type Claims struct {
+	UserID string `json:"user_id"`
+	jwt.StandardClaims
+}
+
+// Keys signs tokens with the current key and verifies them with any of the
+// keys it knows, found by the kid header. Rotation adds a new current key and
+// keeps the previous one until the tokens signed with it expire.
+type Keys struct {
+	method  jwt.SigningMethod
+	current string
+	secrets map[string][]byte
+	ttl     time.Duration
+}
+
+// ParseKeys reads keys written as kid=secret, one per line or separated by
+// commas. The first key signs new tokens, the rest only verify old ones.
+// method is one of HS256, HS384 and HS512.
+func ParseKeys(keys string, method string, ttl time.Duration) (*Keys, error) {
+	m, ok := jwt.GetSigningMethod(method).(*jwt.SigningMethodHMAC)
+	if !ok {
+		return nil, fmt.Errorf("unsupported signing method %q, want one of: HS256, HS384, HS512", method)
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("token TTL must be positive, got %v", ttl)
+	}
+
+	k := &Keys{method: m, secrets: make(map[string][]byte), ttl: ttl}
+	for _, line := range strings.FieldsFunc(keys, func(r rune) bool { return r == '\n' || r == ',' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kid, secret, found := strings.Cut(line, "=")
+		kid, secret = strings.TrimSpace(kid), strings.TrimSpace(secret)
+		switch {
+		case !found || kid == "":
+			return nil, fmt.Errorf("key must be written as kid=secret, got %q", line)
+		case len(secret) < minSecretLength:
+			return nil, fmt.Errorf("secret of key %q must be at least %d bytes long", kid, minSecretLength)
+		case k.secrets[kid] != nil:
+			return nil, fmt.Errorf("key %q is given twice", kid)
+		}
+
+		if k.current == "" {
+			k.current = kid
+		}
+		k.secrets[kid] = []byte(secret)
+	}
+	if k.current == "" {
+		return nil, errors.New("no signing keys given")
+	}
+	return k, nil
+}
+
+// RandomKeys makes a single HS256 key that lives as long as the process, so
+// tokens it signs do not survive a restart.
+func RandomKeys(ttl time.Duration) (*Keys, error) {
+	secret := make([]byte, minSecretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return ParseKeys("random="+hex.EncodeToString(secret), DefaultMethod, ttl)
+}
+
+// Issue signs a token of user valid from now on and returns it with its expiry.
+func (k *Keys) Issue(user string, now time.Time) (string, time.Time, error) {
+	expiresAt := now.Add(k.ttl)
+	token := jwt.NewWithClaims(k.method, Claims{
+		UserID: user,
+		StandardClaims: jwt.StandardClaims{
+			IssuedAt:  now.Unix(),
+			ExpiresAt: expiresAt.Unix(),
+		},
+	})
+	token.Header["kid"] = k.current
+
+	signed, err := token.SignedString(k.secrets[k.current])
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return signed, expiresAt, nil
+}
+
+// Parse verifies the signature and expiry of token and returns its user.
+func (k *Keys) Parse(token string) (string, error) {
+	var claims Claims
+
+	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+		// the algorithm is fixed by configuration, so a token can not
+		// switch verification to "none" or another method
+		if t.Method.Alg() != k.method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %q", t.Method.Alg())
+		}
+		kid, _ := t.Header["kid"].(string)
+		secret, found := k.secrets[kid]
+		if !found {
+			return nil, ErrUnknownKey
+		}
+		return secret, nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if claims.UserID == "" || claims.ExpiresAt == 0 {
+		return "", fmt.Errorf("%w: user_id and exp are required", ErrInvalidToken)
+	}
+	return claims.UserID, nil
+}
@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	oldSecret = strings.Repeat("o", minSecretLength)
+	newSecret = strings.Repeat("n", minSecretLength)
+)
+
+func TestIssueAndParse(t *testing.T) {
+	keys, err := ParseKeys("k1="+oldSecret, DefaultMethod, time.Hour)
+	require.NoError(t, err)
+
+	now := time.Now()
+	token, expiresAt, err := keys.Issue("u1", now)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(time.Hour), expiresAt)
+
+	user, err := keys.Parse(token)
+	require.NoError(t, err)
+	assert.Equal(t, "u1", user)
+
+	expired, _, err := keys.Issue("u1", now.Add(-2*time.Hour))
+	require.NoError(t, err)
+	_, err = keys.Parse(expired)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	_, err = keys.Parse(token[:len(token)-2])
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	_, err = keys.Parse("")
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestRotation(t *testing.T) {
+	before, err := ParseKeys("k1="+oldSecret, DefaultMethod, time.Hour)
+	require.NoError(t, err)
+	oldToken, _, err := before.Issue("u1", time.Now())
+	require.NoError(t, err)
+
+	after, err := ParseKeys("k2="+newSecret+"\nk1="+oldSecret, DefaultMethod, time.Hour)
+	require.NoError(t, err)
+	newToken, _, err := after.Issue("u2", time.Now())
+	require.NoError(t, err)
+
+	parsed, err := jwt.Parse(newToken, func(*jwt.Token) (interface{}, error) { return []byte(newSecret), nil })
+	require.NoError(t, err)
+	assert.Equal(t, "k2", parsed.Header["kid"])
+
+	user, err := after.Parse(oldToken)
+	require.NoError(t, err, "tokens of the previous key are accepted until it is removed")
+	assert.Equal(t, "u1", user)
+
+	_, err = before.Parse(newToken)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestParseRejectsOtherMethods(t *testing.T) {
+	keys, err := ParseKeys("k1="+oldSecret, DefaultMethod, time.Hour)
+	require.NoError(t, err)
+	claims := Claims{UserID: "u1", StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Hour).Unix()}}
+
+	none := jwt.NewWithClaims(jwt.SigningMethodNone, claims)
+	none.Header["kid"] = "k1"
+	token, err := none.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	require.NoError(t, err)
+	_, err = keys.Parse(token)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	hs512 := jwt.NewWithClaims(jwt.SigningMethodHS512, claims)
+	hs512.Header["kid"] = "k1"
+	token, err = hs512.SignedString([]byte(oldSecret))
+	require.NoError(t, err)
+	_, err = keys.Parse(token)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	unknown := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	unknown.Header["kid"] = "k9"
+	token, err = unknown.SignedString([]byte(oldSecret))
+	require.NoError(t, err)
+	_, err = keys.Parse(token)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestParseKeys(t *testing.T) {
+	keys, err := ParseKeys("# rotated on 2022-12-18\nk2 = "+newSecret+",k1="+oldSecret+"\n", "HS512", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, "k2", keys.current)
+	assert.Len(t, keys.secrets, 2)
+
+	for name, tc := range map[string]struct {
+		keys   string
+		method string
+		ttl    time.Duration
+	}{
+		"empty":          {"", DefaultMethod, time.Hour},
+		"no kid":         {"=" + oldSecret, DefaultMethod, time.Hour},
+		"no secret":      {"k1", DefaultMethod, time.Hour},
+		"short secret":   {"k1=secret", DefaultMethod, time.Hour},
+		"duplicate":      {"k1=" + oldSecret + ",k1=" + newSecret, DefaultMethod, time.Hour},
+		"asymmetric":     {"k1=" + oldSecret, "RS256", time.Hour},
+		"unknown method": {"k1=" + oldSecret, "none", time.Hour},
+		"no ttl":         {"k1=" + oldSecret, DefaultMethod, 0},
+	} {
+		_, err := ParseKeys(tc.keys, tc.method, tc.ttl)
+		assert.Error(t, err, name)
+	}
+}
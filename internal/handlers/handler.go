@@ -2,50 +2,213 @@ package handlers
 
 import (
 	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/auth"
 	m "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/middleware"
 	s "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/storage"
 )
 
 type StorageHandlers struct {
 	storage s.Storage
+	deleter *s.Deleter
+	clicks  *s.ClickRecorder
 	mw      m.MiddlewareStruct
 }
 
-func ReadBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
-	var reader io.Reader
+// limitedReader fails with m.ErrTooLarge once more than left bytes are read.
+type limitedReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.left < 0 {
+		return 0, m.ErrTooLarge
+	}
+	// one byte over the limit is enough to tell the body is too large
+	if int64(len(p)) > l.left+1 {
+		p = p[:l.left+1]
+	}
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	if l.left < 0 {
+		return n, m.ErrTooLarge
+	}
+	return n, err
+}
+
+// ReadBody reads the request body, decoding gzip, within limits. On error the
+// response is already written: 413 for a body above limits, 400 for broken
+// gzip.
+func ReadBody(w http.ResponseWriter, r *http.Request, limits m.BodyLimits) ([]byte, error) {
+	defer r.Body.Close()
 
-	if strings.Contains(r.Header.Get("Content-Encoding"), "gzip") {
-		gz, err := gzip.NewReader(r.Body)
+	if r.ContentLength > limits.MaxBodySize {
+		http.Error(w, "request body is too large", http.StatusRequestEntityTooLarge)
+		return nil, m.ErrTooLarge
+	}
+	var reader io.Reader = &limitedReader{r: r.Body, left: limits.MaxBodySize}
+
+	gzipped := strings.Contains(r.Header.Get("Content-Encoding"), "gzip")
+	if gzipped {
+		gz, err := gzip.NewReader(reader)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return nil, err
+			return nil, bodyError(w, err, gzipped)
 		}
-		reader = gz
 		defer gz.Close()
-	} else {
-		reader = r.Body
-		defer r.Body.Close()
+		reader = &limitedReader{r: gz, left: limits.MaxDecodedSize}
 	}
 
 	body, err := io.ReadAll(reader)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return nil, err
+		return nil, bodyError(w, err, gzipped)
 	}
 
 	return body, nil
 }
 
+func bodyError(w http.ResponseWriter, err error, gzipped bool) error {
+	switch {
+	case errors.Is(err, m.ErrTooLarge):
+		http.Error(w, "request body is too large", http.StatusRequestEntityTooLarge)
+	case gzipped:
+		http.Error(w, "malformed gzip body", http.StatusBadRequest)
+	default:
+		http.Error(w, "failed read request", http.StatusInternalServerError)
+	}
+	return err
+}
+
+const (
+	minAliasLength = 3
+	maxAliasLength = 64
+)
+
+// reservedAliases would shadow routes of the service or look like they do.
+var reservedAliases = map[string]bool{
+	"api":      true,
+	"ping":     true,
+	"admin":    true,
+	"debug":    true,
+	"static":   true,
+	"health":   true,
+	"metrics":  true,
+	"internal": true,
+	"user":     true,
+}
+
+// isCode tells whether id can be a short code made by storage IDGenerators or
+// an alias, other ids are rejected before going to storage.
+func isCode(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, c := range id {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func checkAlias(alias string) error {
+	switch {
+	case len(alias) < minAliasLength || len(alias) > maxAliasLength:
+		return fmt.Errorf("alias must be from %d to %d characters long", minAliasLength, maxAliasLength)
+	case !isCode(alias):
+		return errors.New("alias must consist of latin letters, digits, '-' and '_'")
+	case reservedAliases[strings.ToLower(alias)]:
+		return fmt.Errorf("alias %q is reserved", alias)
+	}
+	return nil
+}
+
+// maxTTLSeconds keeps now + ttl_seconds far from overflowing time.Duration.
+const maxTTLSeconds = 100 * 365 * 24 * 60 * 60
+
+// expiry returns the time a link asked with expires_at or ttl_seconds expires
+// at, zero time if it never does.
+func expiry(expiresAt *time.Time, ttlSeconds int64, now time.Time) (time.Time, error) {
+	switch {
+	case expiresAt != nil && ttlSeconds != 0:
+		return time.Time{}, errors.New("only one of expires_at and ttl_seconds can be set")
+	case ttlSeconds < 0 || ttlSeconds > maxTTLSeconds:
+		return time.Time{}, fmt.Errorf("ttl_seconds must be from 1 to %d", maxTTLSeconds)
+	case ttlSeconds > 0:
+		return now.Add(time.Duration(ttlSeconds) * time.Second), nil
+	case expiresAt != nil && !expiresAt.After(now):
+		return time.Time{}, errors.New("expires_at must be in the future")
+	case expiresAt != nil:
+		return *expiresAt, nil
+	}
+	return time.Time{}, nil
+}
+
+// maxClickHeaderLength bounds referrers and user agents stored with clicks.
+const maxClickHeaderLength = 512
+
+// clickHeader cuts a header value for storing, invalid UTF-8 is dropped as
+// text columns do not accept it.
+func clickHeader(value string) string {
+	if len(value) > maxClickHeaderLength {
+		value = value[:maxClickHeaderLength]
+	}
+	return strings.ToValidUTF8(value, "")
+}
+
+// hashIP signs the client address with the secret key, so visitors can be told
+// apart without storing their addresses.
+func hashIP(remoteAddr string, key []byte) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return fmt.Sprintf("%x", m.SetSign(host, key))
+}
+
+func writeJSONError(w http.ResponseWriter, status int, jsonErr m.JSONError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(jsonErr)
+}
+
+// normalizeURL answers 400 with a JSON error for URLs the service would not
+// redirect to and 422 for those the policy blocks, correlationID marks the
+// item of a batch.
+func (sh StorageHandlers) normalizeURL(w http.ResponseWriter, raw string, correlationID string) (string, bool) {
+	url, err := sh.mw.URLs.Normalize(raw)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, m.JSONError{Error: err.Error(), CorrelationID: correlationID})
+		return "", false
+	}
+	if rule, blocked := sh.mw.Policy.Check(url); blocked {
+		writeJSONError(w, http.StatusUnprocessableEntity, m.JSONError{
+			Error: "URL is blocked by policy", CorrelationID: correlationID, Rule: rule.String(),
+		})
+		return "", false
+	}
+	return url, true
+}
+
+func isConflict(err error) bool {
+	var se *m.StorageError
+	return errors.As(err, &se) && errors.Is(se.Err, m.ErrConflict)
+}
+
 func (sh StorageHandlers) PingDB(w http.ResponseWriter, r *http.Request) {
-	err := sh.storage.Ping()
+	err := sh.storage.Ping(r.Context())
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -56,29 +219,26 @@ func (sh StorageHandlers) PingDB(w http.ResponseWriter, r *http.Request) {
 
 func (sh StorageHandlers) PostAddURLHandler(w http.ResponseWriter, r *http.Request) {
 
-	urlBytes, err := ReadBody(w, r)
+	urlBytes, err := ReadBody(w, r, sh.mw.Limits)
 	if err != nil {
 		log.Printf("failed read request: %v", err)
-		http.Error(w, "failed read request", http.StatusInternalServerError)
 		return
 	}
-	url := string(urlBytes)
-	user := r.Context().Value("user").(string)
-	if user == "" {
-		user = m.GetCookie(r, m.CookieUserID)
+	url, ok := sh.normalizeURL(w, string(urlBytes), "")
+	if !ok {
+		return
 	}
+	user, _ := auth.UserFromContext(r.Context())
 
-	fullShortenURL, err := sh.storage.AddURL(url, user)
+	fullShortenURL, err := sh.storage.AddURL(r.Context(), url, user, time.Time{})
 	w.Header().Set("Content-Type", "text/html")
 
-	if err != nil {
-		log.Println("unable to add url", err)
+	if isConflict(err) {
 		w.WriteHeader(http.StatusConflict)
-		//if errors.As(m.NewStorageError(m.ErrConflict, "409"), &err) {
-		//	w.WriteHeader(http.StatusConflict)
-		//} else {
-		//	w.WriteHeader(http.StatusInternalServerError)
-		//}
+	} else if err != nil {
+		log.Println("unable to add url", err)
+		http.Error(w, "failed to add url", http.StatusInternalServerError)
+		return
 	} else {
 		w.WriteHeader(http.StatusCreated)
 	}
@@ -91,36 +251,69 @@ func (sh StorageHandlers) ShortenBatchHandler(w http.ResponseWriter, r *http.Req
 		batchRequestList  []m.JSONBatchRequest
 		batchResponseList []m.JSONBatchResponse
 	)
-	user := r.Context().Value("user").(string)
-	if user == "" {
-		user = m.GetCookie(r, m.CookieUserID)
-	}
+	user, _ := auth.UserFromContext(r.Context())
 
-	urlBytes, err := ReadBody(w, r)
+	urlBytes, err := ReadBody(w, r, sh.mw.Limits)
 	if err != nil {
 		log.Printf("failed read request: %v", err)
-		http.Error(w, "failed read request", http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
+	if err := json.Unmarshal(urlBytes, &batchRequestList); err != nil {
+		log.Println("failed to read request body", err)
+		http.Error(w, "failed to read request body", http.StatusBadRequest)
+		return
+	}
+	if len(batchRequestList) > sh.mw.Limits.MaxBatchSize {
+		http.Error(w, fmt.Sprintf("batch is limited to %d urls", sh.mw.Limits.MaxBatchSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	// the request was let in for one url, the rest are paid by the next ones
+	m.ChargeRate(r.Context(), len(batchRequestList)-1)
 
-	json.Unmarshal([]byte(urlBytes), &batchRequestList)
+	var expiresAt []time.Time
+	now := time.Now()
+	urls := make([]string, len(batchRequestList))
 	for i := range batchRequestList {
-		fullShortenURL, err := sh.storage.AddURL(batchRequestList[i].OriginalURL, user)
-		//if !errors.As(m.NewStorageError(m.ErrConflict, "409"), &err) {
+		url, ok := sh.normalizeURL(w, batchRequestList[i].OriginalURL, batchRequestList[i].CorrelationID)
+		if !ok {
+			return
+		}
+		urls[i] = url
+
+		at, err := expiry(batchRequestList[i].ExpiresAt, batchRequestList[i].TTLSeconds, now)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			http.Error(w, batchRequestList[i].CorrelationID+": "+err.Error(), http.StatusBadRequest)
 			return
 		}
+		if !at.IsZero() && expiresAt == nil {
+			expiresAt = make([]time.Time, len(batchRequestList))
+		}
+		if expiresAt != nil {
+			expiresAt[i] = at
+		}
+	}
 
-		batch := &m.JSONBatchResponse{
+	status := http.StatusCreated
+	fullShortenURLs, err := sh.storage.AddURLBatch(r.Context(), urls, user, expiresAt)
+	if isConflict(err) {
+		status = http.StatusConflict
+	} else if err != nil {
+		log.Println("unable to add urls", err)
+		http.Error(w, "failed to add urls", http.StatusInternalServerError)
+		return
+	}
+
+	batchResponseList = make([]m.JSONBatchResponse, len(batchRequestList))
+	for i := range batchRequestList {
+		batchResponseList[i] = m.JSONBatchResponse{
 			CorrelationID: batchRequestList[i].CorrelationID,
-			ShortenURL:    fullShortenURL,
+			ShortenURL:    fullShortenURLs[i],
 		}
-		batchResponseList = append(batchResponseList, *batch)
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(batchResponseList)
 }
 
@@ -130,16 +323,12 @@ func (sh StorageHandlers) ShortenHandler(w http.ResponseWriter, r *http.Request)
 		newURLShorten m.URLShorten
 	)
 
-	urlBytes, err := ReadBody(w, r)
+	urlBytes, err := ReadBody(w, r, sh.mw.Limits)
 	if err != nil {
 		log.Printf("failed read request: %v", err)
-		http.Error(w, "failed read request", http.StatusInternalServerError)
 		return
 	}
-	user := r.Context().Value("user").(string)
-	if user == "" {
-		user = m.GetCookie(r, m.CookieUserID)
-	}
+	user, _ := auth.UserFromContext(r.Context())
 
 	err = json.Unmarshal(urlBytes, &newURLFull)
 	if err != nil {
@@ -148,22 +337,39 @@ func (sh StorageHandlers) ShortenHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	fullShortenURL, err := sh.storage.AddURL(newURLFull.URLFull, user)
+	url, ok := sh.normalizeURL(w, newURLFull.URLFull, "")
+	if !ok {
+		return
+	}
+	expiresAt, err := expiry(newURLFull.ExpiresAt, newURLFull.TTLSeconds, time.Now())
 	if err != nil {
-		log.Println("failed to read request body", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var fullShortenURL string
+	if newURLFull.Alias != "" {
+		if err := checkAlias(newURLFull.Alias); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fullShortenURL, err = sh.storage.AddURLAlias(r.Context(), url, newURLFull.Alias, user, expiresAt)
+	} else {
+		fullShortenURL, err = sh.storage.AddURL(r.Context(), url, user, expiresAt)
+	}
+	if errors.Is(err, m.ErrAliasTaken) {
+		http.Error(w, "alias is already taken", http.StatusConflict)
+		return
+	} else if err != nil && !isConflict(err) {
+		log.Println("unable to add url", err)
 		http.Error(w, "failed to add url", http.StatusInternalServerError)
 		return
 	}
 
 	newURLShorten.URLShorten = fullShortenURL
 	w.Header().Set("Content-Type", "application/json")
-	if err != nil {
-		//if errors.As(m.NewStorageError(m.ErrConflict, "409"), &err) {
-		//	w.WriteHeader(http.StatusConflict)
-		//} else {
-		//	w.WriteHeader(http.StatusInternalServerError)
-		//}
-		w.WriteHeader(http.StatusInternalServerError)
+	if isConflict(err) {
+		w.WriteHeader(http.StatusConflict)
 	} else {
 		w.WriteHeader(http.StatusCreated)
 	}
@@ -173,17 +379,34 @@ func (sh StorageHandlers) ShortenHandler(w http.ResponseWriter, r *http.Request)
 func (sh StorageHandlers) GetURLHandler(w http.ResponseWriter, r *http.Request) {
 
 	params := mux.Vars(r)
-	id, err := strconv.Atoi(params["id"])
+	id := params["id"]
 
-	if err != nil {
-		http.Error(w, "ID parameter must be Integer type", http.StatusBadRequest)
+	if !isCode(id) {
+		http.Error(w, "ID parameter must consist of latin letters, digits, '-' and '_'", http.StatusBadRequest)
 		return
 	}
-	url, err := sh.storage.SearchURL(id)
-	if err != nil {
+	url, err := sh.storage.SearchURL(r.Context(), id)
+	if errors.Is(err, m.ErrGone) {
+		http.Error(w, "URL with this ID was deleted", http.StatusGone)
+		return
+	}
+	if errors.Is(err, m.ErrNotFound) {
 		http.Error(w, "There is no URL with this ID", http.StatusNotFound)
 		return
+	} else if err != nil {
+		log.Println("unable to find url", err)
+		http.Error(w, "unable to find url", http.StatusInternalServerError)
+		return
 	} else {
+		if sh.clicks != nil {
+			sh.clicks.Record(s.Click{
+				Code:      id,
+				Time:      time.Now(),
+				Referrer:  clickHeader(r.Referer()),
+				UserAgent: clickHeader(r.UserAgent()),
+				IPHash:    hashIP(r.RemoteAddr, sh.mw.SecretKey),
+			})
+		}
 		w.Header().Set("Location", url)
 		w.WriteHeader(http.StatusTemporaryRedirect)
 		w.Write([]byte(url))
@@ -191,46 +414,316 @@ func (sh StorageHandlers) GetURLHandler(w http.ResponseWriter, r *http.Request)
 
 }
 
+func (sh StorageHandlers) GetURLStatsHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !isCode(id) {
+		http.Error(w, "ID parameter must consist of latin letters, digits, '-' and '_'", http.StatusBadRequest)
+		return
+	}
+	user, _ := auth.UserFromContext(r.Context())
+
+	stats, err := sh.storage.LinkStats(r.Context(), id, user)
+	if errors.Is(err, m.ErrNotFound) {
+		http.Error(w, "There is no URL with this ID", http.StatusNotFound)
+		return
+	} else if errors.Is(err, m.ErrForbidden) {
+		http.Error(w, "URL with this ID belongs to another user", http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.Println("unable to get url stats", err)
+		http.Error(w, "unable to get url stats", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
 func (sh StorageHandlers) GetAllURLsHandler(w http.ResponseWriter, r *http.Request) {
-	user := r.Context().Value("user").(string)
-	if user == "" {
-		user = m.GetCookie(r, m.CookieUserID)
+	user, _ := auth.UserFromContext(r.Context())
+
+	JSONStructList, err := sh.storage.GetAllURLForUser(r.Context(), user)
+	if errors.Is(err, m.ErrNoContent) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	} else if err != nil {
+		log.Println("unable to list urls of user", user, err)
+		http.Error(w, "unable to list urls", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(JSONStructList)
+}
+
+func (sh StorageHandlers) GetStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := sh.storage.GetStats(r.Context())
+	if err != nil {
+		log.Println("unable to count urls", err)
+		http.Error(w, "unable to count urls", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// enqueueTimeout is how long deletions wait for room in the queue while
+// storage lags behind, then the client is told to retry.
+const enqueueTimeout = 5 * time.Second
+
+func (sh StorageHandlers) DeleteURLsHandler(w http.ResponseWriter, r *http.Request) {
+	var ids []string
+
+	urlBytes, err := ReadBody(w, r, sh.mw.Limits)
+	if err != nil {
+		log.Printf("failed read request: %v", err)
+		return
+	}
+	user, _ := auth.UserFromContext(r.Context())
+
+	if err := json.Unmarshal(urlBytes, &ids); err != nil {
+		http.Error(w, "request body must be JSON array of IDs", http.StatusBadRequest)
+		return
+	}
+
+	toDelete := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if isCode(id) {
+			toDelete = append(toDelete, id)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), enqueueTimeout)
+	defer cancel()
+	if err := sh.deleter.Enqueue(ctx, user, toDelete); err != nil {
+		log.Println("unable to delete urls", err)
+		http.Error(w, "unable to delete urls", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// RescanHandler checks every live link against the policy file as it is now
+// and disables the blocked ones, ?dry_run=true only lists them.
+func (sh StorageHandlers) RescanHandler(w http.ResponseWriter, r *http.Request) {
+	if sh.mw.Policy == nil {
+		http.Error(w, "no policy file is configured", http.StatusNotFound)
+		return
+	}
+	// an edit made just before the rescan should not wait for the next reload
+	if _, err := sh.mw.Policy.Reload(); err != nil {
+		http.Error(w, "unable to reload policy: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result := m.JSONRescan{Matches: []m.JSONPolicyMatch{}}
+	result.DryRun, _ = strconv.ParseBool(r.URL.Query().Get("dry_run"))
+
+	var codes []string
+	err := sh.storage.Export(r.Context(), func(record m.JSONStruct) error {
+		if record.Deleted {
+			return nil
+		}
+		result.Scanned++
+		rule, blocked := sh.mw.Policy.Check(record.FullURL)
+		if !blocked {
+			return nil
+		}
+		// links made before codes are found by their decimal ID
+		code := record.Code
+		if code == "" {
+			code = strconv.Itoa(record.ShortenURL)
+		}
+		codes = append(codes, code)
+		result.Matches = append(result.Matches, m.JSONPolicyMatch{Code: code, URL: record.FullURL, Rule: rule.String()})
+		return nil
+	})
+	if err != nil {
+		log.Println("unable to scan urls", err)
+		http.Error(w, "unable to scan urls", http.StatusInternalServerError)
+		return
+	}
+
+	if !result.DryRun && len(codes) > 0 {
+		result.Disabled, err = sh.storage.DisableURLs(r.Context(), codes)
+		if err != nil {
+			log.Println("unable to disable urls", err)
+			http.Error(w, "unable to disable urls", http.StatusInternalServerError)
+			return
+		}
+		log.Println("urls disabled by policy:", result.Disabled)
 	}
 
-	JSONStructList, err := sh.storage.GetAllURLForUser(user)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+const maxAPIKeyNameLength = 64
+
+// SignInHandler gives the user of the request a fresh token, a new user is
+// made for requests without credentials. Clients that can not keep cookies
+// send the token as Authorization: Bearer or exchange it for an API key.
+func (sh StorageHandlers) SignInHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.UserFromContext(r.Context())
+
+	// CheckAuth has just issued a token to a new user
+	token, issued := auth.TokenFromContext(r.Context())
+	if !issued {
+		var (
+			expiresAt time.Time
+			err       error
+		)
+		token, expiresAt, err = sh.mw.Keys.Issue(user, time.Now())
+		if err != nil {
+			log.Println("unable to issue token", err)
+			http.Error(w, "unable to issue token", http.StatusInternalServerError)
+			return
+		}
+		m.SetToken(w, token, expiresAt, sh.mw.SecureCookies)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.SignInStruct{UserID: user, Token: token})
+}
+
+func (sh StorageHandlers) AddAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var request m.JSONAPIKeyRequest
+
+	body, err := ReadBody(w, r, sh.mw.Limits)
 	if err != nil {
-		//if errors.As(m.NewStorageError(m.ErrNoContent, "204"), &err) {
-		//	w.WriteHeader(http.StatusNoContent)
-		//} else {
-		//	w.WriteHeader(http.StatusInternalServerError)
-		//}
+		log.Printf("failed read request: %v", err)
+		return
+	}
+	user, _ := auth.UserFromContext(r.Context())
+
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &request); err != nil {
+			http.Error(w, "request body must be JSON object with optional name", http.StatusBadRequest)
+			return
+		}
+	}
+	if len(request.Name) > maxAPIKeyNameLength {
+		http.Error(w, fmt.Sprintf("name must be at most %d characters long", maxAPIKeyNameLength), http.StatusBadRequest)
+		return
+	}
+
+	id, key, err := auth.NewAPIKey()
+	if err != nil {
+		log.Println("unable to make API key", err)
+		http.Error(w, "unable to make API key", http.StatusInternalServerError)
+		return
+	}
+	apiKey := s.APIKey{ID: id, User: user, Name: request.Name, Hash: auth.HashAPIKey(key), CreatedAt: time.Now().UTC()}
+	if err := sh.storage.AddAPIKey(r.Context(), apiKey); err != nil {
+		log.Println("unable to add API key", err)
+		http.Error(w, "unable to add API key", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(m.JSONAPIKey{ID: id, Name: request.Name, Key: key, CreatedAt: apiKey.CreatedAt})
+}
+
+func (sh StorageHandlers) GetAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.UserFromContext(r.Context())
+
+	keys, err := sh.storage.GetAPIKeys(r.Context(), user)
+	if err != nil {
+		log.Println("unable to get API keys", err)
+		http.Error(w, "unable to get API keys", http.StatusInternalServerError)
+		return
+	}
+	if len(keys) == 0 {
 		w.WriteHeader(http.StatusNoContent)
-	} else {
-		json.NewEncoder(w).Encode(JSONStructList)
-		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	list := make([]m.JSONAPIKey, len(keys))
+	for i, key := range keys {
+		list[i] = m.JSONAPIKey{ID: key.ID, Name: key.Name, CreatedAt: key.CreatedAt.UTC()}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func (sh StorageHandlers) DeleteAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	var ids []string
+
+	body, err := ReadBody(w, r, sh.mw.Limits)
+	if err != nil {
+		log.Printf("failed read request: %v", err)
+		return
 	}
+	user, _ := auth.UserFromContext(r.Context())
 
+	if err := json.Unmarshal(body, &ids); err != nil {
+		http.Error(w, "request body must be JSON array of key IDs", http.StatusBadRequest)
+		return
+	}
+
+	if err := sh.storage.DeleteAPIKeys(r.Context(), ids, user); err != nil {
+		log.Println("unable to delete API keys", err)
+		http.Error(w, "unable to delete API keys", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func NewRouter(storage s.Storage, mw m.MiddlewareStruct) *mux.Router {
+// NewRouter builds the routes of the service, clicks may be nil to not record
+// redirects.
+func NewRouter(storage s.Storage, deleter *s.Deleter, clicks *s.ClickRecorder, mw m.MiddlewareStruct) *mux.Router {
 
 	router := mux.NewRouter()
-	router.Use(mw.CheckAuth)
+	mw.APIKeys = storage
+	mw.Limits = mw.Limits.WithDefaults()
+	router.Use(m.Compress)
+	router.Use(mw.Authenticate)
 
 	handlers := StorageHandlers{
 		storage: storage,
+		deleter: deleter,
+		clicks:  clicks,
 		mw:      mw,
 	}
 
-	router.HandleFunc("/", handlers.PostAddURLHandler).Methods("POST")
-	router.HandleFunc("/api/shorten", handlers.ShortenHandler).Methods("POST")
-	router.HandleFunc("/api/shorten/batch", handlers.ShortenBatchHandler).Methods("POST")
-
-	router.HandleFunc("/ping", handlers.PingDB).Methods("GET")
-	router.HandleFunc("/{id}", handlers.GetURLHandler).Methods("GET")
-	router.HandleFunc("/api/user/urls", handlers.GetAllURLsHandler).Methods("GET")
+	// visitors without credentials become new users here
+	public := router.NewRoute().Subrouter()
+	public.Use(mw.CheckAuth)
+
+	// limits run after CheckAuth, so even a new user has a bucket
+	writes := public.NewRoute().Subrouter()
+	writes.Use(mw.WriteLimit.Limit)
+	writes.HandleFunc("/", handlers.PostAddURLHandler).Methods("POST")
+	writes.HandleFunc("/api/shorten", handlers.ShortenHandler).Methods("POST")
+	writes.HandleFunc("/api/shorten/batch", handlers.ShortenBatchHandler).Methods("POST")
+	writes.HandleFunc("/api/sign_in", handlers.SignInHandler).Methods("POST")
+
+	public.HandleFunc("/ping", handlers.PingDB).Methods("GET")
+
+	redirects := public.NewRoute().Subrouter()
+	redirects.Use(mw.RedirectLimit.Limit)
+	redirects.HandleFunc("/{id}", handlers.GetURLHandler).Methods("GET")
+
+	// a new user has nothing to list or manage here, so no user is made
+	private := router.NewRoute().Subrouter()
+	private.Use(auth.RequireUser)
+
+	private.HandleFunc("/api/user/urls", handlers.GetAllURLsHandler).Methods("GET")
+	private.HandleFunc("/api/user/urls/{id}/stats", handlers.GetURLStatsHandler).Methods("GET")
+	private.HandleFunc("/api/user/keys", handlers.GetAPIKeysHandler).Methods("GET")
+
+	privateWrites := private.NewRoute().Subrouter()
+	privateWrites.Use(mw.WriteLimit.Limit)
+	privateWrites.HandleFunc("/api/user/urls", handlers.DeleteURLsHandler).Methods("DELETE")
+	privateWrites.HandleFunc("/api/user/keys", handlers.AddAPIKeyHandler).Methods("POST")
+	privateWrites.HandleFunc("/api/user/keys", handlers.DeleteAPIKeysHandler).Methods("DELETE")
+
+	internal := router.PathPrefix("/api/internal").Subrouter()
+	internal.Use(mw.CheckTrustedSubnet)
+	internal.HandleFunc("/stats", handlers.GetStatsHandler).Methods("GET")
+	internal.HandleFunc("/policy/rescan", handlers.RescanHandler).Methods("POST")
 
 	return router
 }
@@ -0,0 +1,217 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// MinCompressSize is the smallest body worth compressing, below it the
+// encoding overhead eats the gain.
+const MinCompressSize = 1024
+
+// encoder is what gzip, zlib and brotli writers have in common.
+type encoder interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+	Flush() error
+}
+
+// encodings are in order of preference for equal q-values.
+var encodings = []struct {
+	name string
+	pool *sync.Pool
+}{
+	{"br", &sync.Pool{New: func() interface{} { return brotli.NewWriterLevel(nil, 5) }}},
+	{"gzip", &sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}},
+	// "deflate" in HTTP is the zlib format, not raw deflate
+	{"deflate", &sync.Pool{New: func() interface{} { return zlib.NewWriter(nil) }}},
+}
+
+// compressibleTypes are media types besides text/* and +json/+xml suffixes
+// worth compressing, images and archives are compressed already.
+var compressibleTypes = map[string]bool{
+	"application/json":       true,
+	"application/javascript": true,
+	"application/xml":        true,
+	"image/svg+xml":          true,
+}
+
+func isCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || compressibleTypes[mediaType] ||
+		strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// acceptedEncoding picks the index in encodings of the one with the highest
+// q-value in the Accept-Encoding header, -1 when the client accepts none.
+func acceptedEncoding(header string) int {
+	best, bestQ := -1, 0.0
+	q := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		weight := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(param, "=")
+			if strings.TrimSpace(key) != "q" {
+				continue
+			}
+			if v, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				weight = v
+			} else {
+				weight = 0
+			}
+		}
+		q[name] = weight
+	}
+
+	for i, e := range encodings {
+		weight, found := q[e.name]
+		if !found {
+			weight, found = q["*"]
+		}
+		if found && weight > bestQ {
+			best, bestQ = i, weight
+		}
+	}
+	return best
+}
+
+// compressWriter holds the body back until it is MinCompressSize long, is
+// flushed or the handler returns, and only then decides whether to compress.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding int
+
+	status  int
+	buf     []byte
+	decided bool
+	enc     encoder
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if cw.decided {
+		if cw.enc != nil {
+			return cw.enc.Write(p)
+		}
+		return cw.ResponseWriter.Write(p)
+	}
+
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) >= MinCompressSize {
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush sends what is buffered, a streamed body is compressed when its type
+// allows no matter how short the first chunk is.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		if err := cw.decide(true); err != nil {
+			return
+		}
+	}
+	if cw.enc != nil {
+		cw.enc.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// decide sends the header with or without Content-Encoding and then the
+// buffered body.
+func (cw *compressWriter) decide(large bool) error {
+	cw.decided = true
+	header := cw.Header()
+	if header.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		header.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+
+	if large && cw.status != http.StatusNoContent && cw.status != http.StatusNotModified &&
+		header.Get("Content-Encoding") == "" && isCompressible(header.Get("Content-Type")) {
+		e := encodings[cw.encoding]
+		cw.enc = e.pool.Get().(encoder)
+		cw.enc.Reset(cw.ResponseWriter)
+		header.Set("Content-Encoding", e.name)
+		header.Del("Content-Length")
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.enc != nil {
+		_, err = cw.enc.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// close ends the response once the handler returns.
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		if cw.status == 0 {
+			// nothing was written, net/http answers 200 with no body itself
+			return
+		}
+		cw.decide(false)
+	}
+	if cw.enc != nil {
+		cw.enc.Close()
+		cw.enc.Reset(nil)
+		encodings[cw.encoding].pool.Put(cw.enc)
+		cw.enc = nil
+	}
+}
+
+// Compress encodes responses with br, gzip or deflate as the client's
+// Accept-Encoding allows, skipping short bodies and types that do not shrink.
+func Compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding < 0 || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
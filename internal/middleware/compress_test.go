@@ -0,0 +1,80 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressStreamed(t *testing.T) {
+	handler := Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		flusher := w.(http.Flusher)
+
+		io.WriteString(w, "[")
+		for i := 0; i < 3; i++ {
+			if i > 0 {
+				io.WriteString(w, ",")
+			}
+			fmt.Fprintf(w, `{"short_url":"http://localhost:8080/%d"}`, i)
+			// every chunk is far below MinCompressSize
+			flusher.Flush()
+		}
+		io.WriteString(w, "]")
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/user/urls", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.True(t, rec.Flushed)
+
+	gz, err := gzip.NewReader(rec.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	var urls []map[string]string
+	require.NoError(t, json.Unmarshal(body, &urls))
+	assert.Len(t, urls, 3)
+}
+
+func TestCompressSkips(t *testing.T) {
+	large := make([]byte, 2*MinCompressSize)
+	for name, tc := range map[string]struct {
+		method      string
+		contentType string
+		encoding    string
+	}{
+		"image":          {http.MethodGet, "image/png", ""},
+		"encoded":        {http.MethodGet, "application/json", "br"},
+		"head":           {http.MethodHead, "application/json", ""},
+		"bad media type": {http.MethodGet, "json;;", ""},
+	} {
+		handler := Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", tc.contentType)
+			if tc.encoding != "" {
+				w.Header().Set("Content-Encoding", tc.encoding)
+			}
+			w.Write(large)
+		}))
+
+		req := httptest.NewRequest(tc.method, "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, tc.encoding, rec.Header().Get("Content-Encoding"), name)
+		assert.Equal(t, len(large), rec.Body.Len(), name)
+		assert.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"), name)
+	}
+}
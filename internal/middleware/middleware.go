@@ -5,15 +5,22 @@ import (
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gofrs/uuid"
 	"log"
+	"net"
 	"net/http"
-	"os"
+	"strings"
+	"time"
+
+	"github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/auth"
+	"github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/policy"
+	"github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/urlnorm"
 )
 
+const CookieToken = "token"
+
 const (
 	CookieUserID   = "UserID"
 	CookieUserSign = "UserSigned"
@@ -22,17 +29,90 @@ const (
 var (
 	ErrConflict  = errors.New(`409 Conflict`)
 	ErrNoContent = errors.New(`204 No Content`)
-	SecretKey    = GenerateRandom(16)
+	ErrGone      = errors.New(`410 Gone`)
+	ErrNotFound  = errors.New(`404 Not Found`)
+	ErrForbidden = errors.New(`403 Forbidden`)
+	ErrTooLarge  = errors.New(`413 Request Entity Too Large`)
+	// ErrAliasTaken is a 409 as well, but unlike ErrConflict there is no link
+	// of the caller to return.
+	ErrAliasTaken = errors.New(`409 alias is already taken`)
 )
 
 type SignInStruct struct {
 	UserID string `json:"user_id"`
+	Token  string `json:"token"`
+}
+
+type JSONAPIKeyRequest struct {
+	Name string `json:"name"`
+}
+
+// JSONAPIKey carries Key only in the response to its creation.
+type JSONAPIKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	Key       string    `json:"key,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// APIKeyUsers finds users by hashes of their API keys, see auth.HashAPIKey.
+type APIKeyUsers interface {
+	UserByAPIKey(ctx context.Context, hash string) (string, error)
+}
+
+const (
+	DefaultMaxBodySize    = 1 << 20
+	DefaultMaxDecodedSize = 8 << 20
+	DefaultMaxBatchSize   = 1000
+)
+
+// BodyLimits caps what a single request may make the server hold in memory.
+type BodyLimits struct {
+	// MaxBodySize is the body as sent, compressed or not.
+	MaxBodySize int64
+	// MaxDecodedSize is the body after gzip is decoded, it keeps a small
+	// gzip bomb from unpacking into gigabytes.
+	MaxDecodedSize int64
+	// MaxBatchSize is the number of URLs shortened by one batch request.
+	MaxBatchSize int
+}
+
+// WithDefaults fills the limits left zero.
+func (l BodyLimits) WithDefaults() BodyLimits {
+	if l.MaxBodySize <= 0 {
+		l.MaxBodySize = DefaultMaxBodySize
+	}
+	if l.MaxDecodedSize <= 0 {
+		l.MaxDecodedSize = DefaultMaxDecodedSize
+	}
+	if l.MaxBatchSize <= 0 {
+		l.MaxBatchSize = DefaultMaxBatchSize
+	}
+	return l
 }
 
 type MiddlewareStruct struct {
+	// SecretKey keys hashes of client addresses, users are signed by Keys.
 	SecretKey []byte
+	Keys      *auth.Keys
+	APIKeys   APIKeyUsers
 	BaseURL   string
 	Server    string
+	// SecureCookies marks the token cookie Secure, for a service served over
+	// HTTPS.
+	SecureCookies bool
+	// TrustedSubnet is the only subnet internal endpoints answer to, nil
+	// closes them for everyone.
+	TrustedSubnet *net.IPNet
+	Limits        BodyLimits
+	// URLs brings links to one form before they are stored.
+	URLs urlnorm.Normalizer
+	// Policy refuses links to blocked hosts, nil lets everything through.
+	Policy *policy.Engine
+	// WriteLimit and RedirectLimit are the budgets of requests that make
+	// links and of redirects, nil ones do not limit.
+	WriteLimit    *RateLimiter
+	RedirectLimit *RateLimiter
 }
 
 type JSONStructForAuth struct {
@@ -43,11 +123,18 @@ type JSONStructForAuth struct {
 type JSONStruct struct {
 	FullURL    string `json:"fullURL"`
 	ShortenURL int    `json:"shortenURL"`
+	Code       string `json:"code,omitempty"`
 	User       string `json:"user"`
+	Deleted    bool   `json:"deleted,omitempty"`
+	// ExpiresAt is unix time in seconds, 0 for links that never expire.
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
 }
 
 type URLFull struct {
-	URLFull string `json:"url"`
+	URLFull    string     `json:"url"`
+	Alias      string     `json:"alias,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	TTLSeconds int64      `json:"ttl_seconds,omitempty"`
 }
 
 type URLShorten struct {
@@ -55,8 +142,38 @@ type URLShorten struct {
 }
 
 type JSONBatchRequest struct {
-	CorrelationID string `json:"correlation_id"`
-	OriginalURL   string `json:"original_url"`
+	CorrelationID string     `json:"correlation_id"`
+	OriginalURL   string     `json:"original_url"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	TTLSeconds    int64      `json:"ttl_seconds,omitempty"`
+}
+
+// JSONError explains a rejected request, CorrelationID points at the item of
+// a batch and Rule at the policy rule that blocked it.
+type JSONError struct {
+	Error         string `json:"error"`
+	CorrelationID string `json:"correlation_id,omitempty"`
+	Rule          string `json:"rule,omitempty"`
+}
+
+// JSONPolicyMatch is a stored link blocked by the policy.
+type JSONPolicyMatch struct {
+	Code string `json:"code"`
+	URL  string `json:"url"`
+	Rule string `json:"rule"`
+}
+
+// JSONRescan reports links checked against the policy and those disabled.
+type JSONRescan struct {
+	Scanned  int               `json:"scanned"`
+	Disabled int               `json:"disabled"`
+	DryRun   bool              `json:"dry_run,omitempty"`
+	Matches  []JSONPolicyMatch `json:"matches"`
+}
+
+type JSONStats struct {
+	URLs  int `json:"urls"`
+	Users int `json:"users"`
 }
 
 type JSONBatchResponse struct {
@@ -88,30 +205,6 @@ func SetSign(id string, key []byte) []byte {
 	return h.Sum(nil)
 }
 
-func CreateFile(filePath string) {
-	f, err := os.Create(filePath)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer f.Close()
-}
-
-func InitMapByJSON(filePath string) []JSONStruct {
-	jsonString, err := os.ReadFile(filePath)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	targets := []JSONStruct{}
-
-	err = json.Unmarshal(jsonString, &targets)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return targets
-
-}
-
 type StorageError struct {
 	Label string
 	Err   error
@@ -129,42 +222,120 @@ func NewStorageError(err error, label string) error {
 	return &StorageError{Err: err, Label: label}
 }
 
+// bearerToken returns the token of an Authorization: Bearer header.
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > len("Bearer ") && strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		return strings.TrimSpace(header[len("Bearer "):])
+	}
+	return ""
+}
+
+// SetToken hands token to the client in the cookie. A secure cookie is sent
+// back over HTTPS only. Clients without cookies take the token from
+// POST /api/sign_in instead.
+func SetToken(w http.ResponseWriter, token string, expiresAt time.Time, secure bool) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieToken,
+		Value:    token,
+		Path:     "/",
+		Expires:  expiresAt,
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Authenticate identifies the user by the X-API-Key header, a JWT from the
+// Authorization: Bearer header or the token cookie and puts it into the
+// request context, see auth.UserFromContext. A bad API key or Bearer token is
+// 401, as clients sending them can not take a new cookie, while a bad cookie
+// is treated as no cookie at all.
+func (s *MiddlewareStruct) Authenticate(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if key := r.Header.Get("X-API-Key"); key != "" {
+			var (
+				userID string
+				err    error = ErrNotFound
+			)
+			if s.APIKeys != nil {
+				userID, err = s.APIKeys.UserByAPIKey(r.Context(), auth.HashAPIKey(key))
+			}
+			if errors.Is(err, ErrNotFound) {
+				http.Error(w, "invalid API key", http.StatusUnauthorized)
+				return
+			} else if err != nil {
+				log.Println("unable to check API key", err)
+				http.Error(w, "unable to check API key", http.StatusInternalServerError)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(auth.WithUser(r.Context(), userID)))
+			return
+		}
+
+		if token := bearerToken(r); token != "" {
+			userID, err := s.Keys.Parse(token)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, "invalid token", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(auth.WithUser(r.Context(), userID)))
+			return
+		}
+
+		if userID, err := s.Keys.Parse(GetCookie(r, CookieToken)); err == nil {
+			r = r.WithContext(auth.WithUser(r.Context(), userID))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CheckAuth makes a new user for requests Authenticate found no user in and
+// hands its token to the client with SetToken. The token is put into the
+// request context as well, see auth.TokenFromContext.
 func (s *MiddlewareStruct) CheckAuth(next http.Handler) http.Handler {
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		reqUserID := GetCookie(r, CookieUserID)
-		reqUserSign := GetCookie(r, CookieUserSign)
-
-		var (
-			UserID   string
-			UserSign []byte
-		)
-
-		if reqUserID == "" || reqUserSign == "" ||
-			(reqUserID != "" && reqUserSign != "" &&
-				reqUserSign != fmt.Sprintf("%x", SetSign(reqUserID, SecretKey))) {
-			u, _ := uuid.NewV4()
-			UserID = u.String()
-			UserSign = SetSign(UserID, SecretKey)
-
-			cookieSign := &http.Cookie{
-				Name:  CookieUserSign,
-				Value: fmt.Sprintf("%x", UserSign),
-				Path:  "/",
+		if _, ok := auth.UserFromContext(r.Context()); !ok {
+			u, err := uuid.NewV4()
+			if err != nil {
+				log.Println("unable to make user id", err)
+				http.Error(w, "unable to make user id", http.StatusInternalServerError)
+				return
 			}
-			cookieUserID := &http.Cookie{
-				Name:  CookieUserID,
-				Value: UserID,
-				Path:  "/",
+			userID := u.String()
+
+			token, expiresAt, err := s.Keys.Issue(userID, time.Now())
+			if err != nil {
+				log.Println("unable to issue token", err)
+				http.Error(w, "unable to issue token", http.StatusInternalServerError)
+				return
 			}
-			http.SetCookie(w, cookieSign)
-			http.SetCookie(w, cookieUserID)
+			SetToken(w, token, expiresAt, s.SecureCookies)
+
+			r = r.WithContext(auth.WithToken(auth.WithUser(r.Context(), userID), token))
 		}
 
-		ctx := context.WithValue(r.Context(), "user", UserID)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CheckTrustedSubnet lets through requests whose X-Real-IP belongs to the
+// trusted subnet and answers 403 to everyone else.
+func (s *MiddlewareStruct) CheckTrustedSubnet(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		ip := net.ParseIP(r.Header.Get("X-Real-IP"))
+		if s.TrustedSubnet == nil || ip == nil || !s.TrustedSubnet.Contains(ip) {
+			http.Error(w, "access is allowed from the trusted subnet only", http.StatusForbidden)
+			return
+		}
 
-		r = r.WithContext(ctx)
 		next.ServeHTTP(w, r)
 	})
 }
@@ -0,0 +1,260 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/auth"
+)
+
+// sweepInterval is how often full buckets are dropped, a full bucket is the
+// same as no bucket at all.
+const sweepInterval = time.Minute
+
+// RateLimit is a token bucket budget: Burst requests at once and then one
+// every Per/Count.
+type RateLimit struct {
+	Count int
+	Per   time.Duration
+	Burst int
+}
+
+// ParseRateLimit reads limits written as count/unit with an optional burst,
+// like 60/m or 10/s,50; the unit is one of s, m and h and the burst defaults
+// to count. An empty string or 0 turns limiting off.
+func ParseRateLimit(s string) (RateLimit, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "0" {
+		return RateLimit{}, nil
+	}
+
+	rate, burst, hasBurst := strings.Cut(s, ",")
+	count, unit, found := strings.Cut(rate, "/")
+	per := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}[strings.TrimSpace(unit)]
+	n, err := strconv.Atoi(strings.TrimSpace(count))
+	if !found || per == 0 || err != nil || n <= 0 {
+		return RateLimit{}, fmt.Errorf("rate limit must be written as count/unit like 60/m, got %q", s)
+	}
+
+	limit := RateLimit{Count: n, Per: per, Burst: n}
+	if hasBurst {
+		limit.Burst, err = strconv.Atoi(strings.TrimSpace(burst))
+		if err != nil || limit.Burst <= 0 {
+			return RateLimit{}, fmt.Errorf("burst of rate limit %q must be a positive integer", s)
+		}
+	}
+	return limit, nil
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter keeps a token bucket for every user and every client address.
+// A request has to find a token in both, so neither a new cookie per request
+// nor many addresses behind one user get around it.
+type RateLimiter struct {
+	limit  RateLimit
+	realIP bool
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewRateLimiter returns nil for a zero limit, a nil RateLimiter lets every
+// request through. realIP takes client addresses from X-Real-IP, only for a
+// service behind a proxy that sets it; otherwise clients could pick their own.
+func NewRateLimiter(limit RateLimit, realIP bool) *RateLimiter {
+	if limit.Count <= 0 {
+		return nil
+	}
+	return &RateLimiter{
+		limit:   limit,
+		realIP:  realIP,
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// perSecond is the refill rate of a bucket.
+func (l *RateLimiter) perSecond() float64 {
+	return float64(l.limit.Count) / l.limit.Per.Seconds()
+}
+
+// refill brings the bucket of key to now, new buckets start full.
+func (l *RateLimiter) refill(key string, now time.Time) *bucket {
+	b, found := l.buckets[key]
+	if !found {
+		b = &bucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[key] = b
+		return b
+	}
+	b.tokens = math.Min(float64(l.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*l.perSecond())
+	b.last = now
+	return b
+}
+
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key := range l.buckets {
+		if l.refill(key, now).tokens >= float64(l.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateState is what the RateLimit-* headers tell about the emptiest bucket.
+type rateState struct {
+	remaining  int
+	reset      time.Duration
+	retryAfter time.Duration
+}
+
+// take spends a token of every key if each has one left.
+func (l *RateLimiter) take(keys []string) (rateState, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	buckets := make([]*bucket, len(keys))
+	allowed := true
+	for i, key := range keys {
+		buckets[i] = l.refill(key, now)
+		if buckets[i].tokens < 1 {
+			allowed = false
+		}
+	}
+	if allowed {
+		for _, b := range buckets {
+			b.tokens--
+		}
+	}
+
+	state := rateState{remaining: math.MaxInt}
+	for _, b := range buckets {
+		remaining := int(math.Max(0, math.Floor(b.tokens)))
+		if remaining < state.remaining {
+			state.remaining = remaining
+		}
+		reset := l.until(float64(l.limit.Burst) - b.tokens)
+		if reset > state.reset {
+			state.reset = reset
+		}
+		if b.tokens < 1 {
+			if wait := l.until(1 - b.tokens); wait > state.retryAfter {
+				state.retryAfter = wait
+			}
+		}
+	}
+	return state, allowed
+}
+
+// until is the time to refill tokens.
+func (l *RateLimiter) until(tokens float64) time.Duration {
+	if tokens <= 0 {
+		return 0
+	}
+	return time.Duration(tokens / l.perSecond() * float64(time.Second))
+}
+
+// clientKey is the address of the client, IPv6 clients get a /64 each as
+// they usually hold a whole one.
+func (l *RateLimiter) clientKey(r *http.Request) string {
+	addr := r.RemoteAddr
+	if l.realIP && r.Header.Get("X-Real-IP") != "" {
+		addr = r.Header.Get("X-Real-IP")
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return "ip:" + addr
+	}
+	if ip.To4() == nil {
+		ip = ip.Mask(net.CIDRMask(64, 128))
+	}
+	return "ip:" + ip.String()
+}
+
+func (l *RateLimiter) keys(r *http.Request) []string {
+	keys := []string{l.clientKey(r)}
+	if user, ok := auth.UserFromContext(r.Context()); ok {
+		keys = append(keys, "user:"+user)
+	}
+	return keys
+}
+
+// seconds rounds d up, so clients retrying on time find a token.
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+func (l *RateLimiter) setHeaders(w http.ResponseWriter, state rateState) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(l.limit.Burst))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(state.remaining))
+	w.Header().Set("RateLimit-Reset", seconds(state.reset))
+}
+
+type rateChargeKey struct{}
+
+type rateCharge struct {
+	limiter *RateLimiter
+	keys    []string
+}
+
+// Limit answers 429 with Retry-After to requests over the limit, it has to
+// run after users are resolved.
+func (l *RateLimiter) Limit(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys := l.keys(r)
+		state, allowed := l.take(keys)
+		l.setHeaders(w, state)
+		if !allowed {
+			w.Header().Set("Retry-After", seconds(state.retryAfter))
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), rateChargeKey{}, rateCharge{limiter: l, keys: keys})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// ChargeRate spends n more tokens of the request admitted by Limit, for
+// requests that do the work of many, like a batch of URLs. The request goes
+// on and the following ones wait for the debt to refill. The debt is at most
+// Burst, so one big batch costs no more than two full buckets of waiting.
+func ChargeRate(ctx context.Context, n int) {
+	charge, ok := ctx.Value(rateChargeKey{}).(rateCharge)
+	if !ok || n <= 0 {
+		return
+	}
+	l := charge.limiter
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	for _, key := range charge.keys {
+		b := l.refill(key, now)
+		b.tokens = math.Max(-float64(l.limit.Burst), b.tokens-float64(n))
+	}
+}
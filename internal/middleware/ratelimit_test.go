@@ -0,0 +1,131 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	for s, want := range map[string]RateLimit{
+		"":        {},
+		"0":       {},
+		"60/m":    {Count: 60, Per: time.Minute, Burst: 60},
+		"10/s,50": {Count: 10, Per: time.Second, Burst: 50},
+		" 5 / h ": {Count: 5, Per: time.Hour, Burst: 5},
+	} {
+		got, err := ParseRateLimit(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, want, got, s)
+	}
+
+	for _, s := range []string{"60", "60/d", "x/m", "-1/m", "10/s,0", "10/s,x"} {
+		_, err := ParseRateLimit(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2022, 12, 25, 12, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter(RateLimit{Count: 1, Per: time.Second, Burst: 2}, false)
+	limiter.now = func() time.Time { return now }
+
+	handler := limiter.Limit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ChargeRate(r.Context(), len(r.URL.Query().Get("batch")))
+	}))
+	request := func(remoteAddr string, user string, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/"+query, nil)
+		req.RemoteAddr = remoteAddr
+		if user != "" {
+			req = req.WithContext(auth.WithUser(req.Context(), user))
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("192.0.2.1:1000", "u1", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Reset"))
+
+	assert.Equal(t, http.StatusOK, request("192.0.2.1:1001", "u1", "").Code)
+	w = request("192.0.2.1:1002", "u1", "")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+
+	// the same user from another address and another user from the same
+	// address are both out of tokens
+	assert.Equal(t, http.StatusTooManyRequests, request("192.0.2.2:1000", "u1", "").Code)
+	assert.Equal(t, http.StatusTooManyRequests, request("192.0.2.1:1000", "u2", "").Code)
+	assert.Equal(t, http.StatusOK, request("192.0.2.3:1000", "u3", "").Code)
+
+	// addresses of one IPv6 /64 share a bucket
+	assert.Equal(t, http.StatusOK, request("[2001:db8::1]:1000", "", "").Code)
+	assert.Equal(t, http.StatusOK, request("[2001:db8::2]:1000", "", "").Code)
+	assert.Equal(t, http.StatusTooManyRequests, request("[2001:db8::3]:1000", "", "").Code)
+	assert.Equal(t, http.StatusOK, request("[2001:db8:0:1::1]:1000", "", "").Code)
+
+	now = now.Add(time.Second)
+	assert.Equal(t, http.StatusOK, request("192.0.2.1:1000", "u1", "").Code)
+
+	// a batch of 5 is let in on one token and charged 4 more, but the debt
+	// of the bucket of 2 stops at 2, so a huge batch does not lock the
+	// client out for long
+	now = now.Add(time.Minute)
+	assert.Equal(t, http.StatusOK, request("192.0.2.4:1000", "u4", "?batch=xxxx").Code)
+	now = now.Add(2 * time.Second)
+	w = request("192.0.2.4:1000", "u4", "")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Equal(t, "2", w.Header().Get("RateLimit-Reset"))
+	now = now.Add(time.Second)
+	assert.Equal(t, http.StatusOK, request("192.0.2.4:1000", "u4", "").Code)
+}
+
+func TestRateLimiterEvictsIdleBuckets(t *testing.T) {
+	now := time.Date(2022, 12, 25, 12, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter(RateLimit{Count: 10, Per: time.Second, Burst: 10}, false)
+	limiter.now = func() time.Time { return now }
+
+	for _, key := range []string{"ip:a", "ip:b", "ip:c"} {
+		_, allowed := limiter.take([]string{key})
+		require.True(t, allowed)
+	}
+	assert.Len(t, limiter.buckets, 3)
+
+	now = now.Add(sweepInterval)
+	limiter.take([]string{"ip:d"})
+	assert.Len(t, limiter.buckets, 1, "refilled buckets are dropped, only the new one is left")
+}
+
+func TestRateLimiterRealIP(t *testing.T) {
+	for _, realIP := range []bool{false, true} {
+		limiter := NewRateLimiter(RateLimit{Count: 1, Per: time.Hour, Burst: 1}, realIP)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "10.0.0.1:1000"
+		req.Header.Set("X-Real-IP", "192.0.2.1")
+		if realIP {
+			assert.Equal(t, "ip:192.0.2.1", limiter.clientKey(req))
+		} else {
+			assert.Equal(t, "ip:10.0.0.1", limiter.clientKey(req))
+		}
+	}
+
+	var disabled *RateLimiter
+	assert.Nil(t, NewRateLimiter(RateLimit{}, false))
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	w := httptest.NewRecorder()
+	disabled.Limit(next).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("RateLimit-Limit"))
+	ChargeRate(context.Background(), 10)
+}
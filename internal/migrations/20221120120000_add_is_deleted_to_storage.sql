@@ -0,0 +1,4 @@
+-- +goose Up
+ALTER TABLE public.storage ADD COLUMN IF NOT EXISTS is_deleted boolean NOT NULL DEFAULT false;
+-- +goose Down
+ALTER TABLE public.storage DROP COLUMN IF EXISTS is_deleted;
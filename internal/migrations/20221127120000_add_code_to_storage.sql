@@ -0,0 +1,8 @@
+-- +goose Up
+ALTER TABLE public.storage ADD COLUMN IF NOT EXISTS code text;
+UPDATE public.storage SET code = id::text WHERE code IS NULL;
+ALTER TABLE public.storage ALTER COLUMN code SET NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS index_code ON public.storage USING btree (code);
+-- +goose Down
+DROP INDEX IF EXISTS public.index_code;
+ALTER TABLE public.storage DROP COLUMN IF EXISTS code;
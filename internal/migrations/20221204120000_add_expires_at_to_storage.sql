@@ -0,0 +1,6 @@
+-- +goose Up
+ALTER TABLE public.storage ADD COLUMN IF NOT EXISTS expires_at timestamptz NULL;
+CREATE INDEX IF NOT EXISTS index_expires_at ON public.storage USING btree (expires_at) WHERE is_deleted = false;
+-- +goose Down
+DROP INDEX IF EXISTS public.index_expires_at;
+ALTER TABLE public.storage DROP COLUMN IF EXISTS expires_at;
@@ -0,0 +1,20 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS public.clicks (
+                         id BIGSERIAL PRIMARY KEY,
+                         code text NOT NULL,
+                         clicked_at timestamptz NOT NULL,
+                         referrer text NOT NULL DEFAULT '',
+                         user_agent text NOT NULL DEFAULT '',
+                         ip_hash text NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS index_clicks_code ON public.clicks USING btree (code, clicked_at);
+CREATE TABLE IF NOT EXISTS public.click_buckets (
+                         code text NOT NULL,
+                         period text NOT NULL,
+                         started_at timestamptz NOT NULL,
+                         clicks bigint NOT NULL,
+                         PRIMARY KEY (code, period, started_at)
+);
+-- +goose Down
+DROP TABLE IF EXISTS public.click_buckets;
+DROP TABLE IF EXISTS public.clicks;
@@ -0,0 +1,12 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS public.api_keys (
+                         id text PRIMARY KEY,
+                         user_id text NOT NULL,
+                         name text NOT NULL DEFAULT '',
+                         hash text NOT NULL,
+                         created_at timestamptz NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS index_api_keys_hash ON public.api_keys USING btree (hash);
+CREATE INDEX IF NOT EXISTS index_api_keys_user_id ON public.api_keys USING btree (user_id);
+-- +goose Down
+DROP TABLE IF EXISTS public.api_keys;
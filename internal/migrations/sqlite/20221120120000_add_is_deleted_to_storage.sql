@@ -0,0 +1,4 @@
+-- +goose Up
+ALTER TABLE storage ADD COLUMN is_deleted boolean NOT NULL DEFAULT false;
+-- +goose Down
+ALTER TABLE storage DROP COLUMN is_deleted;
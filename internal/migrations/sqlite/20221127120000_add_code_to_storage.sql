@@ -0,0 +1,7 @@
+-- +goose Up
+ALTER TABLE storage ADD COLUMN code text;
+UPDATE storage SET code = CAST(id AS text) WHERE code IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS index_code ON storage (code);
+-- +goose Down
+DROP INDEX IF EXISTS index_code;
+ALTER TABLE storage DROP COLUMN code;
@@ -0,0 +1,6 @@
+-- +goose Up
+ALTER TABLE storage ADD COLUMN expires_at integer NULL;
+CREATE INDEX IF NOT EXISTS index_expires_at ON storage (expires_at) WHERE is_deleted = false;
+-- +goose Down
+DROP INDEX IF EXISTS index_expires_at;
+ALTER TABLE storage DROP COLUMN expires_at;
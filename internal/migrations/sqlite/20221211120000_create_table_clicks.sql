@@ -0,0 +1,20 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS clicks (
+                         id INTEGER PRIMARY KEY AUTOINCREMENT,
+                         code text NOT NULL,
+                         clicked_at integer NOT NULL,
+                         referrer text NOT NULL DEFAULT '',
+                         user_agent text NOT NULL DEFAULT '',
+                         ip_hash text NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS index_clicks_code ON clicks (code, clicked_at);
+CREATE TABLE IF NOT EXISTS click_buckets (
+                         code text NOT NULL,
+                         period text NOT NULL,
+                         started_at integer NOT NULL,
+                         clicks integer NOT NULL,
+                         PRIMARY KEY (code, period, started_at)
+);
+-- +goose Down
+DROP TABLE IF EXISTS click_buckets;
+DROP TABLE IF EXISTS clicks;
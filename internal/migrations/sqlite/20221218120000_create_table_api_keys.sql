@@ -0,0 +1,12 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS api_keys (
+                         id text PRIMARY KEY,
+                         user_id text NOT NULL,
+                         name text NOT NULL DEFAULT '',
+                         hash text NOT NULL,
+                         created_at integer NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS index_api_keys_hash ON api_keys (hash);
+CREATE INDEX IF NOT EXISTS index_api_keys_user_id ON api_keys (user_id);
+-- +goose Down
+DROP TABLE IF EXISTS api_keys;
@@ -0,0 +1,7 @@
+-- +goose Up
+-- deleted and expired links keep their codes, the url may be shortened anew
+DROP INDEX IF EXISTS index_name;
+CREATE UNIQUE INDEX IF NOT EXISTS index_name ON storage (full_url) WHERE is_deleted = false;
+-- +goose Down
+DROP INDEX IF EXISTS index_name;
+CREATE UNIQUE INDEX IF NOT EXISTS index_name ON storage (full_url);
@@ -0,0 +1,264 @@
+// Package policy decides which URLs may be shortened by rules kept in a file,
+// so known phishing and malware hosts are refused without a redeploy.
+package policy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/idna"
+)
+
+type Action string
+
+const (
+	Allow Action = "allow"
+	Block Action = "block"
+)
+
+// Rule is one line of the policy file: an action and a pattern, which is one
+// of
+//
+//	example.com      the host itself
+//	*.example.com    any subdomain of example.com, but not example.com
+//	*                any host
+//	10.0.0.0/8       hosts written as addresses within the network
+//	re:^https?://... a regular expression matched against the whole URL
+//
+// Host names are not resolved, so CIDR rules only catch links to addresses.
+type Rule struct {
+	Action  Action
+	Pattern string
+	Line    int
+
+	match func(u *url.URL, raw string) bool
+}
+
+func (r Rule) String() string {
+	return fmt.Sprintf("%s %s (line %d)", r.Action, r.Pattern, r.Line)
+}
+
+// Rules of a policy file. Allow rules are exceptions from block rules, so a
+// blocklist is made of block rules and an allowlist of "block *" and allow
+// rules for the hosts to let through.
+type Rules struct {
+	allow []Rule
+	block []Rule
+}
+
+func hostOf(u *url.URL) string {
+	return strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+}
+
+func parseRule(action Action, pattern string, line int) (Rule, error) {
+	rule := Rule{Action: action, Pattern: pattern, Line: line}
+
+	if strings.HasPrefix(pattern, "re:") {
+		re, err := regexp.Compile(strings.TrimPrefix(pattern, "re:"))
+		if err != nil {
+			return Rule{}, err
+		}
+		rule.match = func(u *url.URL, raw string) bool { return re.MatchString(raw) }
+		return rule, nil
+	}
+
+	if pattern == "*" {
+		rule.match = func(u *url.URL, raw string) bool { return true }
+		return rule, nil
+	}
+
+	var network *net.IPNet
+	if ip := net.ParseIP(pattern); ip != nil {
+		bits := 8 * len(ip.To16())
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else if _, n, err := net.ParseCIDR(pattern); err == nil {
+		network = n
+	}
+	if network != nil {
+		rule.match = func(u *url.URL, raw string) bool {
+			ip := net.ParseIP(u.Hostname())
+			return ip != nil && network.Contains(ip)
+		}
+		return rule, nil
+	}
+
+	wildcard := strings.HasPrefix(pattern, "*.")
+	host, err := idna.Lookup.ToASCII(strings.TrimSuffix(strings.TrimPrefix(pattern, "*."), "."))
+	if err != nil {
+		return Rule{}, fmt.Errorf("host %q: %v", pattern, err)
+	}
+	if wildcard {
+		suffix := "." + host
+		rule.match = func(u *url.URL, raw string) bool { return strings.HasSuffix(hostOf(u), suffix) }
+	} else {
+		rule.match = func(u *url.URL, raw string) bool { return hostOf(u) == host }
+	}
+	return rule, nil
+}
+
+// Parse reads rules written as "block pattern" or "allow pattern", one per
+// line. Empty lines and lines starting with # are skipped.
+func Parse(r io.Reader) (*Rules, error) {
+	rules := &Rules{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		// any blanks separate the action, a regexp keeps the ones inside it
+		fields := strings.Fields(text)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: rule must be written as action pattern, got %q", line, text)
+		}
+		action := fields[0]
+		pattern := strings.TrimSpace(text[len(action):])
+		rule, err := parseRule(Action(action), pattern, line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		switch rule.Action {
+		case Allow:
+			rules.allow = append(rules.allow, rule)
+		case Block:
+			rules.block = append(rules.block, rule)
+		default:
+			return nil, fmt.Errorf("line %d: action must be allow or block, got %q", line, action)
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// Check returns the block rule matching rawURL, which should be normalized
+// already, and true if the URL is blocked. Unparsable URLs are not blocked,
+// rejecting them is up to URL validation.
+func (rs *Rules) Check(rawURL string) (Rule, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil || rs == nil {
+		return Rule{}, false
+	}
+	for _, rule := range rs.allow {
+		if rule.match(u, rawURL) {
+			return Rule{}, false
+		}
+	}
+	for _, rule := range rs.block {
+		if rule.match(u, rawURL) {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+// Engine holds the rules of a file and checks it for changes every interval,
+// a file that fails to parse leaves the previous rules in place.
+type Engine struct {
+	path     string
+	interval time.Duration
+	rules    atomic.Value // *Rules
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewEngine loads the rules of path and, with a positive interval, reloads
+// them whenever the file changes.
+func NewEngine(path string, interval time.Duration) (*Engine, error) {
+	e := &Engine{
+		path:     path,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+	if _, err := e.Reload(); err != nil {
+		return nil, err
+	}
+
+	if interval > 0 {
+		e.wg.Add(1)
+		go e.run()
+	}
+	return e, nil
+}
+
+// Close stops watching the file.
+func (e *Engine) Close() {
+	close(e.stop)
+	e.wg.Wait()
+}
+
+func (e *Engine) run() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if reloaded, err := e.Reload(); err != nil {
+				log.Println("unable to reload policy, keeping the previous rules:", err)
+			} else if reloaded {
+				log.Println("policy reloaded from", e.path)
+			}
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+// Reload reads the file again if its size or modification time changed and
+// tells whether it did.
+func (e *Engine) Reload() (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	info, err := os.Stat(e.path)
+	if err != nil {
+		return false, err
+	}
+	if e.rules.Load() != nil && info.ModTime().Equal(e.modTime) && info.Size() == e.size {
+		return false, nil
+	}
+
+	f, err := os.Open(e.path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	rules, err := Parse(f)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", e.path, err)
+	}
+	e.rules.Store(rules)
+	e.modTime, e.size = info.ModTime(), info.Size()
+	return true, nil
+}
+
+// Check is Rules.Check with the current rules, a nil Engine blocks nothing.
+func (e *Engine) Check(rawURL string) (Rule, bool) {
+	if e == nil {
+		return Rule{}, false
+	}
+	rules, _ := e.rules.Load().(*Rules)
+	return rules.Check(rawURL)
+}
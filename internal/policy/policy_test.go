@@ -0,0 +1,125 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRules = `# phishing reported on 2022-12-20
+block evil.com
+block *.phish.example
+allow safe.phish.example
+block 10.0.0.0/8
+block 2001:db8::1
+block re:^https?://[^/]+/wp-login\.php
+block пример.рф
+`
+
+func TestCheck(t *testing.T) {
+	rules, err := Parse(strings.NewReader(testRules))
+	require.NoError(t, err)
+
+	for url, want := range map[string]string{
+		"https://evil.com/":                     "block evil.com (line 2)",
+		"https://EVIL.com./login":               "block evil.com (line 2)",
+		"https://a.b.phish.example/":            "block *.phish.example (line 3)",
+		"http://10.1.2.3:8080/":                 "block 10.0.0.0/8 (line 5)",
+		"http://[2001:db8::1]/":                 "block 2001:db8::1 (line 6)",
+		"https://blog.example.com/wp-login.php": "block re:^https?://[^/]+/wp-login\\.php (line 7)",
+		"https://xn--e1afmkfd.xn--p1ai/":        "block пример.рф (line 8)",
+	} {
+		rule, blocked := rules.Check(url)
+		assert.True(t, blocked, url)
+		assert.Equal(t, want, rule.String(), url)
+	}
+
+	for _, url := range []string{
+		"https://notevil.com/",
+		"https://evil.com.example.org/",
+		"https://phish.example/",
+		"https://safe.phish.example/",
+		"http://11.0.0.1/",
+		"https://blog.example.com/about/wp-login.php",
+		"https://10.example.com/",
+	} {
+		_, blocked := rules.Check(url)
+		assert.False(t, blocked, url)
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	rules, err := Parse(strings.NewReader("block *\nallow example.com\nallow *.example.com\n"))
+	require.NoError(t, err)
+
+	_, blocked := rules.Check("https://example.com/")
+	assert.False(t, blocked)
+	_, blocked = rules.Check("https://docs.example.com/")
+	assert.False(t, blocked)
+	rule, blocked := rules.Check("https://github.com/")
+	assert.True(t, blocked)
+	assert.Equal(t, "block * (line 1)", rule.String())
+}
+
+func TestParseBlanks(t *testing.T) {
+	rules, err := Parse(strings.NewReader("block\tevil.com\nblock    *.phish.example\n\tallow \t safe.phish.example\n"))
+	require.NoError(t, err)
+
+	for url, want := range map[string]bool{
+		"https://evil.com/":           true,
+		"https://a.phish.example/":    true,
+		"https://safe.phish.example/": false,
+	} {
+		_, blocked := rules.Check(url)
+		assert.Equal(t, want, blocked, url)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for name, rules := range map[string]string{
+		"no pattern":     "block",
+		"blank pattern":  "block \t ",
+		"unknown action": "deny evil.com",
+		"bad regexp":     "block re:(",
+		"bad host":       "block exa mple.com",
+	} {
+		_, err := Parse(strings.NewReader(rules))
+		assert.Error(t, err, name)
+	}
+}
+
+func TestEngineReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.txt")
+	require.NoError(t, os.WriteFile(path, []byte("block evil.com\n"), 0600))
+
+	engine, err := NewEngine(path, 10*time.Millisecond)
+	require.NoError(t, err)
+	defer engine.Close()
+
+	_, blocked := engine.Check("https://evil.com/")
+	assert.True(t, blocked)
+
+	require.NoError(t, os.WriteFile(path, []byte("block other.com\n"), 0600))
+	assert.Eventually(t, func() bool {
+		_, blocked := engine.Check("https://other.com/")
+		return blocked
+	}, time.Second, 10*time.Millisecond)
+	_, blocked = engine.Check("https://evil.com/")
+	assert.False(t, blocked)
+
+	// a broken file keeps the rules in place
+	require.NoError(t, os.WriteFile(path, []byte("deny everything\n"), 0600))
+	_, err = engine.Reload()
+	assert.Error(t, err)
+	_, blocked = engine.Check("https://other.com/")
+	assert.True(t, blocked)
+
+	var nilEngine *Engine
+	_, blocked = nilEngine.Check("https://evil.com/")
+	assert.False(t, blocked)
+}
@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// APIKey lets scripts act as User without cookies. Hash is the only trace of
+// the key itself.
+type APIKey struct {
+	ID        string    `json:"id"`
+	User      string    `json:"user"`
+	Name      string    `json:"name,omitempty"`
+	Hash      string    `json:"hash"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// userAPIKeys returns keys of user from keys by hash in the order they were
+// made.
+func userAPIKeys(keys map[string]APIKey, user string) []APIKey {
+	var result []APIKey
+	for _, key := range keys {
+		if key.User == user {
+			result = append(result, key)
+		}
+	}
+	sortAPIKeys(result)
+	return result
+}
+
+func sortAPIKeys(keys []APIKey) {
+	sort.Slice(keys, func(i, k int) bool {
+		if !keys[i].CreatedAt.Equal(keys[k].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[k].CreatedAt)
+		}
+		return keys[i].ID < keys[k].ID
+	})
+}
+
+// deleteAPIKeys removes keys of user with ids from keys by hash and tells
+// whether there were any.
+func deleteAPIKeys(keys map[string]APIKey, ids []string, user string) bool {
+	toDelete := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		toDelete[id] = true
+	}
+
+	var deleted bool
+	for hash, key := range keys {
+		if key.User == user && toDelete[key.ID] {
+			delete(keys, hash)
+			deleted = true
+		}
+	}
+	return deleted
+}
+
+// importAPIKeys puts imported keys into keys by hash, skipping those whose ID
+// or hash is used already, and returns the added ones.
+func importAPIKeys(keys map[string]APIKey, imported []APIKey) []APIKey {
+	ids := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		ids[key.ID] = true
+	}
+
+	var added []APIKey
+	for _, key := range imported {
+		if _, found := keys[key.Hash]; found || ids[key.ID] {
+			continue
+		}
+		keys[key.Hash] = key
+		ids[key.ID] = true
+		added = append(added, key)
+	}
+	return added
+}
+
+// sortedAPIKeys returns all keys in the order they were made.
+func sortedAPIKeys(keys map[string]APIKey) []APIKey {
+	list := make([]APIKey, 0, len(keys))
+	for _, key := range keys {
+		list = append(list, key)
+	}
+	sortAPIKeys(list)
+	return list
+}
+
+// loadAPIKeys reads keys File keeps next to its journal, a missing file means
+// there are no keys yet.
+func loadAPIKeys(path string) (map[string]APIKey, error) {
+	keys := make(map[string]APIKey)
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return keys, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var list []APIKey
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("read API keys %s: %w", path, err)
+	}
+	for _, key := range list {
+		keys[key.Hash] = key
+	}
+	return keys, nil
+}
+
+// saveAPIKeys rewrites the whole file, keys are few and rarely change.
+func saveAPIKeys(path string, keys map[string]APIKey) error {
+	data, err := json.Marshal(sortedAPIKeys(keys))
+	if err != nil {
+		return err
+	}
+	return replaceFile(path, path+".tmp", data, 0600)
+}
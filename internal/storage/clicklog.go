@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// clickLog is the clicks file File keeps next to its journal, one JSON line
+// per raw click. Compact folds the raw clicks into one line per hourly
+// counter, so the file and the replay on start grow with the counters, not
+// with the clicks.
+type clickLog struct {
+	*appender
+}
+
+// clickLine is a line of the clicks file: a raw click or an hourly counter
+// written by Compact or an import.
+type clickLine struct {
+	*Click
+	Bucket *ClickCounter `json:"bucket,omitempty"`
+}
+
+// openClickLog reads the lines stored at path and opens it for appending. A
+// torn last line left by a crash is cut off.
+func openClickLog(path string, policy SyncPolicy) (*clickLog, []clickLine, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, err
+	}
+
+	valid := bytes.LastIndexByte(data, '\n') + 1
+	var lines []clickLine
+	for n, line := range bytes.Split(data[:valid], []byte{'\n'}) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var l clickLine
+		if err := json.Unmarshal(line, &l); err != nil {
+			return nil, nil, fmt.Errorf("read clicks %s: line %d: %w", path, n+1, err)
+		}
+		lines = append(lines, l)
+	}
+
+	a, err := openAppender(path, policy, data, int64(valid), len(lines))
+	if err != nil {
+		return nil, nil, err
+	}
+	return &clickLog{a}, lines, nil
+}
+
+// Append writes raw clicks with a single write call, like Journal.Append.
+func (l *clickLog) Append(clicks []Click) error {
+	lines := make([]clickLine, len(clicks))
+	for i := range clicks {
+		lines[i] = clickLine{Click: &clicks[i]}
+	}
+	data, err := marshalClickLines(lines)
+	if err != nil {
+		return err
+	}
+	return l.write(data, len(lines))
+}
+
+// AppendCounters writes hourly counters, e.g. imported ones, like Append.
+func (l *clickLog) AppendCounters(counters []ClickCounter) error {
+	data, err := marshalClickLines(counterLines(counters))
+	if err != nil {
+		return err
+	}
+	return l.write(data, len(counters))
+}
+
+// Compact replaces the file with one line per hourly counter, the raw clicks
+// counted in them are dropped.
+func (l *clickLog) Compact(counters []ClickCounter) error {
+	data, err := marshalClickLines(counterLines(counters))
+	if err != nil {
+		return err
+	}
+	return l.replace(data, len(counters))
+}
+
+func counterLines(counters []ClickCounter) []clickLine {
+	lines := make([]clickLine, len(counters))
+	for i := range counters {
+		lines[i] = clickLine{Bucket: &counters[i]}
+	}
+	return lines
+}
+
+func marshalClickLines(lines []clickLine) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, line := range lines {
+		if err := enc.Encode(line); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// countClickLines adds the raw clicks and the hourly counters read from the
+// clicks file to counters of the links they belong to.
+func countClickLines(lines []clickLine, codeID map[string]int, counters map[int]*clickCounters) {
+	var (
+		clicks []Click
+		hourly []ClickCounter
+	)
+	for _, line := range lines {
+		switch {
+		case line.Bucket != nil:
+			hourly = append(hourly, *line.Bucket)
+		case line.Click != nil:
+			clicks = append(clicks, *line.Click)
+		}
+	}
+	addCounters(hourly, codeID, counters)
+	countClicks(clicks, codeID, counters)
+}
@@ -0,0 +1,296 @@
+package storage
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	periodHour = "hour"
+	periodDay  = "day"
+)
+
+// Click is a single redirect by a short link. IPHash is a keyed hash of the
+// client address, the address itself is never stored.
+type Click struct {
+	Code      string    `json:"code"`
+	Time      time.Time `json:"time"`
+	Referrer  string    `json:"referrer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	IPHash    string    `json:"ip_hash,omitempty"`
+}
+
+type ClickBucket struct {
+	Start  time.Time `json:"start"`
+	Clicks int64     `json:"clicks"`
+}
+
+// LinkStats holds the click counters of a link, buckets are in UTC and sorted
+// by their start.
+type LinkStats struct {
+	Code   string        `json:"code"`
+	Clicks int64         `json:"clicks"`
+	Hourly []ClickBucket `json:"hourly"`
+	Daily  []ClickBucket `json:"daily"`
+}
+
+// ClickCounter is the number of clicks of the link with Code in the hour that
+// starts at Start, a unix time. Click stats move between storages as hourly
+// counters, the daily ones are their sums.
+type ClickCounter struct {
+	Code   string `json:"code"`
+	Start  int64  `json:"start"`
+	Clicks int64  `json:"clicks"`
+}
+
+// bucketKey identifies a counter: the link, hour or day and the unix time the
+// bucket starts at.
+type bucketKey struct {
+	Code   string
+	Period string
+	Start  int64
+}
+
+// bucketStarts returns the unix time of the hour and of the UTC day at holds.
+// The zero time is midnight UTC, so truncation by 24 hours gives days in UTC.
+func bucketStarts(at time.Time) (hour int64, day int64) {
+	at = at.UTC()
+	return at.Truncate(time.Hour).Unix(), at.Truncate(24 * time.Hour).Unix()
+}
+
+// aggregateClicks counts clicks per bucket, so a batch turns into a single
+// update of every counter it touches.
+func aggregateClicks(clicks []Click) map[bucketKey]int64 {
+	counters := make(map[bucketKey]int64)
+	for _, c := range clicks {
+		hour, day := bucketStarts(c.Time)
+		counters[bucketKey{Code: c.Code, Period: periodHour, Start: hour}]++
+		counters[bucketKey{Code: c.Code, Period: periodDay, Start: day}]++
+	}
+	return counters
+}
+
+// newLinkStats sorts the buckets and sums up the total from the daily ones.
+func newLinkStats(code string, hourly []ClickBucket, daily []ClickBucket) LinkStats {
+	stats := LinkStats{Code: code, Hourly: hourly, Daily: daily}
+	for _, bucket := range [][]ClickBucket{stats.Hourly, stats.Daily} {
+		sort.Slice(bucket, func(i, k int) bool { return bucket[i].Start.Before(bucket[k].Start) })
+	}
+	if stats.Hourly == nil {
+		stats.Hourly = []ClickBucket{}
+	}
+	if stats.Daily == nil {
+		stats.Daily = []ClickBucket{}
+	}
+	for _, b := range stats.Daily {
+		stats.Clicks += b.Clicks
+	}
+	return stats
+}
+
+// clickCounters keeps the buckets of a single link for storages without a
+// database.
+type clickCounters struct {
+	hourly map[int64]int64
+	daily  map[int64]int64
+}
+
+func (c *clickCounters) add(key bucketKey, n int64) {
+	if c.hourly == nil {
+		c.hourly = make(map[int64]int64)
+		c.daily = make(map[int64]int64)
+	}
+	if key.Period == periodHour {
+		c.hourly[key.Start] += n
+	} else {
+		c.daily[key.Start] += n
+	}
+}
+
+// hourlyCount returns the counter of the hour at start, c may be nil.
+func (c *clickCounters) hourlyCount(start int64) (int64, bool) {
+	if c == nil {
+		return 0, false
+	}
+	n, found := c.hourly[start]
+	return n, found
+}
+
+func (c *clickCounters) stats(code string) LinkStats {
+	buckets := func(counters map[int64]int64) []ClickBucket {
+		result := make([]ClickBucket, 0, len(counters))
+		for start, n := range counters {
+			result = append(result, ClickBucket{Start: time.Unix(start, 0).UTC(), Clicks: n})
+		}
+		return result
+	}
+	if c == nil {
+		return newLinkStats(code, nil, nil)
+	}
+	return newLinkStats(code, buckets(c.hourly), buckets(c.daily))
+}
+
+// hourlyCounters lists the hourly counters of all links ordered by code and
+// start.
+func hourlyCounters(codes map[int]string, counters map[int]*clickCounters) []ClickCounter {
+	var result []ClickCounter
+	for id, c := range counters {
+		for start, n := range c.hourly {
+			result = append(result, ClickCounter{Code: codes[id], Start: start, Clicks: n})
+		}
+	}
+	sort.Slice(result, func(i, k int) bool {
+		if result[i].Code != result[k].Code {
+			return result[i].Code < result[k].Code
+		}
+		return result[i].Start < result[k].Start
+	})
+	return result
+}
+
+// filterCounters drops imported counters of codes that are not stored, of
+// hours their link has a counter for already and repeated ones.
+func filterCounters(imported []ClickCounter, codeID map[string]int, counters map[int]*clickCounters) []ClickCounter {
+	type hourKey struct {
+		id    int
+		start int64
+	}
+	seen := make(map[hourKey]bool, len(imported))
+	result := make([]ClickCounter, 0, len(imported))
+	for _, c := range imported {
+		id, found := codeID[c.Code]
+		if !found || seen[hourKey{id, c.Start}] {
+			continue
+		}
+		if _, counted := counters[id].hourlyCount(c.Start); counted {
+			continue
+		}
+		seen[hourKey{id, c.Start}] = true
+		result = append(result, c)
+	}
+	return result
+}
+
+// addCounters adds hourly counters to the hours and days of their links.
+func addCounters(list []ClickCounter, codeID map[string]int, counters map[int]*clickCounters) {
+	for _, c := range list {
+		id, found := codeID[c.Code]
+		if !found {
+			continue
+		}
+		if counters[id] == nil {
+			counters[id] = &clickCounters{}
+		}
+		hour, day := bucketStarts(time.Unix(c.Start, 0))
+		counters[id].add(bucketKey{Code: c.Code, Period: periodHour, Start: hour}, c.Clicks)
+		counters[id].add(bucketKey{Code: c.Code, Period: periodDay, Start: day}, c.Clicks)
+	}
+}
+
+// ClickRecorder takes clicks from the redirect handler and writes them to
+// storage in batches from a single goroutine. Record never waits for storage:
+// when the buffer is full clicks are dropped and counted instead.
+type ClickRecorder struct {
+	// dropped goes first to be 64-bit aligned for atomic operations
+	dropped       uint64
+	storage       Storage
+	events        chan Click
+	batchSize     int
+	flushInterval time.Duration
+
+	mu     sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func NewClickRecorder(st Storage, bufferSize int, batchSize int, flushInterval time.Duration) *ClickRecorder {
+	if bufferSize < 1 {
+		bufferSize = 1
+	}
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	r := &ClickRecorder{
+		storage:       st,
+		events:        make(chan Click, bufferSize),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+	}
+
+	r.wg.Add(1)
+	go r.run()
+	return r
+}
+
+// Record queues c and reports whether it was accepted.
+func (r *ClickRecorder) Record(c Click) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return false
+	}
+
+	select {
+	case r.events <- c:
+		return true
+	default:
+		atomic.AddUint64(&r.dropped, 1)
+		return false
+	}
+}
+
+// Close stops accepting clicks and waits until the queued ones are written.
+func (r *ClickRecorder) Close() {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.closed = true
+	close(r.events)
+	r.mu.Unlock()
+
+	r.wg.Wait()
+}
+
+func (r *ClickRecorder) run() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Click, 0, r.batchSize)
+	flush := func() {
+		if dropped := atomic.SwapUint64(&r.dropped, 0); dropped > 0 {
+			log.Println("click buffer is full, dropped clicks:", dropped)
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := r.storage.AddClicks(context.Background(), batch); err != nil {
+			log.Println("unable to record", len(batch), "clicks", err)
+		}
+		batch = make([]Click, 0, r.batchSize)
+	}
+
+	for {
+		select {
+		case c, ok := <-r.events:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, c)
+			if len(batch) >= r.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
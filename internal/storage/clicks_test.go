@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClickRecorder(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory("http://localhost:8080/")
+
+	_, err := m.AddURL(ctx, "https://github.com/", "u1", time.Time{})
+	require.NoError(t, err)
+
+	r := NewClickRecorder(m, 10, 2, time.Hour)
+	at := time.Date(2022, 12, 11, 10, 30, 0, 0, time.UTC)
+	for _, c := range []Click{
+		{Code: "1", Time: at},
+		{Code: "1", Time: at.Add(time.Hour)},
+		{Code: "missing", Time: at},
+		{Code: "1", Time: at.Add(24 * time.Hour)},
+	} {
+		assert.True(t, r.Record(c))
+	}
+
+	// the batch size is reached before Close, the rest is flushed by it
+	assert.Eventually(t, func() bool {
+		stats, err := m.LinkStats(ctx, "1", "u1")
+		return err == nil && stats.Clicks >= 1
+	}, time.Second, 10*time.Millisecond)
+	r.Close()
+	assert.False(t, r.Record(Click{Code: "1", Time: at}))
+
+	stats, err := m.LinkStats(ctx, "1", "u1")
+	require.NoError(t, err)
+	assert.Equal(t, LinkStats{
+		Code:   "1",
+		Clicks: 3,
+		Hourly: []ClickBucket{
+			{Start: time.Date(2022, 12, 11, 10, 0, 0, 0, time.UTC), Clicks: 1},
+			{Start: time.Date(2022, 12, 11, 11, 0, 0, 0, time.UTC), Clicks: 1},
+			{Start: time.Date(2022, 12, 12, 10, 0, 0, 0, time.UTC), Clicks: 1},
+		},
+		Daily: []ClickBucket{
+			{Start: time.Date(2022, 12, 11, 0, 0, 0, 0, time.UTC), Clicks: 2},
+			{Start: time.Date(2022, 12, 12, 0, 0, 0, 0, time.UTC), Clicks: 1},
+		},
+	}, stats)
+}
+
+func TestFileClicksSurviveRestart(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.json")
+	f, err := NewFile("http://localhost:8080/", path, FileConfig{Sync: SyncAlways})
+	require.NoError(t, err)
+	_, err = f.AddURL(ctx, "https://github.com/", "u1", time.Time{})
+	require.NoError(t, err)
+
+	at := time.Date(2022, 12, 11, 10, 30, 0, 0, time.UTC)
+	click := Click{Code: "1", Time: at, Referrer: "https://ya.ru/", UserAgent: "curl/7.81.0", IPHash: "ab12"}
+	require.NoError(t, f.AddClicks(ctx, []Click{click, {Code: "missing", Time: at}}))
+	require.NoError(t, f.Close())
+
+	// a crash in the middle of an append leaves a torn line behind
+	clicksFile, err := os.OpenFile(path+".clicks", os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = clicksFile.WriteString(`{"code":"1","ti`)
+	require.NoError(t, err)
+	require.NoError(t, clicksFile.Close())
+
+	f, err = NewFile("http://localhost:8080/", path, FileConfig{Sync: SyncAlways})
+	require.NoError(t, err)
+	require.NoError(t, f.AddClicks(ctx, []Click{{Code: "1", Time: at.Add(time.Hour)}}))
+	stats, err := f.LinkStats(ctx, "1", "u1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), stats.Clicks)
+	require.NoError(t, f.Close())
+
+	clickLog, lines, err := openClickLog(path+".clicks", SyncNever)
+	require.NoError(t, err)
+	require.NoError(t, clickLog.Close())
+	assert.Equal(t, []clickLine{{Click: &click}, {Click: &Click{Code: "1", Time: at.Add(time.Hour)}}}, lines)
+}
+
+func TestFileClicksCompact(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.json")
+	f, err := NewFile("http://localhost:8080/", path, FileConfig{Sync: SyncAlways})
+	require.NoError(t, err)
+	_, err = f.AddURL(ctx, "https://github.com/", "u1", time.Time{})
+	require.NoError(t, err)
+
+	at := time.Date(2022, 12, 11, 10, 30, 0, 0, time.UTC)
+	require.NoError(t, f.AddClicks(ctx, []Click{{Code: "1", Time: at}, {Code: "1", Time: at.Add(time.Minute)}}))
+	require.NoError(t, f.AddClicks(ctx, []Click{{Code: "1", Time: at.Add(2 * time.Minute)}, {Code: "1", Time: at.Add(time.Hour)}}))
+	f.compact()
+	assert.Equal(t, 2, f.clicks.Lines(), "raw clicks are folded into one line per hour")
+	want, err := f.LinkStats(ctx, "1", "u1")
+	require.NoError(t, err)
+
+	// clicks appended after compaction are replayed on top of the buckets
+	require.NoError(t, f.AddClicks(ctx, []Click{{Code: "1", Time: at.Add(3 * time.Minute)}}))
+	require.NoError(t, f.Close())
+
+	f, err = NewFile("http://localhost:8080/", path, FileConfig{Sync: SyncAlways})
+	require.NoError(t, err)
+	defer f.Close()
+	stats, err := f.LinkStats(ctx, "1", "u1")
+	require.NoError(t, err)
+	want.Clicks++
+	want.Hourly[0].Clicks++
+	want.Daily[0].Clicks++
+	assert.Equal(t, want, stats)
+	assert.Equal(t, int64(5), stats.Clicks)
+}
+
+// blockedStorage holds AddClicks until release is closed.
+type blockedStorage struct {
+	Storage
+	release chan struct{}
+}
+
+func (b blockedStorage) AddClicks(ctx context.Context, clicks []Click) error {
+	<-b.release
+	return nil
+}
+
+func TestClickRecorderDropsWhenFull(t *testing.T) {
+	st := blockedStorage{Storage: NewMemory(""), release: make(chan struct{})}
+	r := NewClickRecorder(st, 1, 1, time.Hour)
+
+	// the worker takes at most one click before it blocks on storage, and one
+	// more fits into the buffer
+	accepted := 0
+	for i := 0; i < 10; i++ {
+		if r.Record(Click{Code: "1", Time: time.Now()}) {
+			accepted++
+		}
+	}
+	assert.GreaterOrEqual(t, accepted, 1)
+	assert.LessOrEqual(t, accepted, 2)
+
+	close(st.release)
+	r.Close()
+}
@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+)
+
+var ErrDeleterClosed = errors.New("deleter is closed")
+
+type DeleteRequest struct {
+	User string
+	IDs  []string
+}
+
+// Deleter collects deletion requests from handlers, merges them into a single
+// stream and flushes them to storage in per-user batches through a bounded pool
+// of workers, so that many small requests turn into a few DeleteURLs calls.
+type Deleter struct {
+	storage       Storage
+	inputs        []chan DeleteRequest
+	jobs          chan DeleteRequest
+	batchSize     int
+	flushInterval time.Duration
+
+	mu     sync.RWMutex
+	closed bool
+	// done wakes senders waiting for room, senders counts them, so Close
+	// closes inputs only once nobody can send to them anymore
+	done    chan struct{}
+	senders sync.WaitGroup
+	wg      sync.WaitGroup
+}
+
+func NewDeleter(st Storage, workers int, batchSize int, flushInterval time.Duration) *Deleter {
+	if workers < 1 {
+		workers = 1
+	}
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	d := &Deleter{
+		storage:       st,
+		inputs:        make([]chan DeleteRequest, workers),
+		jobs:          make(chan DeleteRequest, workers),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		done:          make(chan struct{}),
+	}
+	for i := range d.inputs {
+		d.inputs[i] = make(chan DeleteRequest, batchSize)
+	}
+
+	d.wg.Add(1)
+	go d.batch(fanIn(d.inputs...))
+
+	for i := 0; i < workers; i++ {
+		d.wg.Add(1)
+		go d.work()
+	}
+	return d
+}
+
+// Enqueue puts ids of the user to the deletion queue. Requests of the same user
+// always go through the same input channel, so they are not reordered. While
+// storage lags behind and the queue is full, it waits until ctx is done or the
+// deleter is closed.
+func (d *Deleter) Enqueue(ctx context.Context, user string, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	d.mu.RLock()
+	if d.closed {
+		d.mu.RUnlock()
+		return ErrDeleterClosed
+	}
+	d.senders.Add(1)
+	d.mu.RUnlock()
+	defer d.senders.Done()
+
+	h := fnv.New32a()
+	h.Write([]byte(user))
+	select {
+	case d.inputs[h.Sum32()%uint32(len(d.inputs))] <- DeleteRequest{User: user, IDs: ids}:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("deletion queue is full: %w", ctx.Err())
+	case <-d.done:
+		return ErrDeleterClosed
+	}
+}
+
+// Close stops accepting new requests and waits until everything already queued
+// is written to storage.
+func (d *Deleter) Close() {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.closed = true
+	close(d.done)
+	d.mu.Unlock()
+
+	d.senders.Wait()
+	for _, in := range d.inputs {
+		close(in)
+	}
+	d.wg.Wait()
+}
+
+func fanIn(inputs ...chan DeleteRequest) <-chan DeleteRequest {
+	var wg sync.WaitGroup
+	out := make(chan DeleteRequest)
+
+	for _, in := range inputs {
+		wg.Add(1)
+		go func(in <-chan DeleteRequest) {
+			defer wg.Done()
+			for req := range in {
+				out <- req
+			}
+		}(in)
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+func (d *Deleter) batch(in <-chan DeleteRequest) {
+	defer d.wg.Done()
+	defer close(d.jobs)
+
+	var (
+		pending = make(map[string][]string)
+		count   int
+		ticker  = time.NewTicker(d.flushInterval)
+	)
+	defer ticker.Stop()
+
+	flush := func() {
+		for user, ids := range pending {
+			d.jobs <- DeleteRequest{User: user, IDs: ids}
+		}
+		pending = make(map[string][]string)
+		count = 0
+	}
+
+	for {
+		select {
+		case req, ok := <-in:
+			if !ok {
+				flush()
+				return
+			}
+			pending[req.User] = append(pending[req.User], req.IDs...)
+			count += len(req.IDs)
+			if count >= d.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (d *Deleter) work() {
+	defer d.wg.Done()
+
+	for job := range d.jobs {
+		if err := d.storage.DeleteURLs(context.Background(), job.IDs, job.User); err != nil {
+			log.Println("unable to delete urls", job.IDs, "of user", job.User, err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stalledStorage holds DeleteURLs until release is closed, like a database
+// that stopped answering.
+type stalledStorage struct {
+	Storage
+	release chan struct{}
+}
+
+func (s stalledStorage) DeleteURLs(ctx context.Context, ids []string, user string) error {
+	<-s.release
+	return s.Storage.DeleteURLs(ctx, ids, user)
+}
+
+func TestDeleterEnqueueTimeout(t *testing.T) {
+	st := stalledStorage{Storage: NewMemory("http://localhost:8080/"), release: make(chan struct{})}
+	d := NewDeleter(st, 1, 1, time.Hour)
+
+	var err error
+	for i := 0; i < 100 && err == nil; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		err = d.Enqueue(ctx, "u1", []string{"1"})
+		cancel()
+	}
+	require.Error(t, err, "the queue never filled up")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	close(st.release)
+	d.Close()
+	assert.ErrorIs(t, d.Enqueue(context.Background(), "u1", []string{"1"}), ErrDeleterClosed)
+}
+
+func TestDeleterCloseWakesEnqueue(t *testing.T) {
+	st := stalledStorage{Storage: NewMemory("http://localhost:8080/"), release: make(chan struct{})}
+	d := NewDeleter(st, 1, 1, time.Hour)
+
+	var err error
+	for i := 0; i < 100 && err == nil; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		err = d.Enqueue(ctx, "u1", []string{"1"})
+		cancel()
+	}
+	require.Error(t, err, "the queue never filled up")
+
+	// the queue is full, so this one waits for room with no deadline
+	enqueued := make(chan error)
+	go func() { enqueued <- d.Enqueue(context.Background(), "u1", []string{"2"}) }()
+	closed := make(chan struct{})
+	go func() {
+		d.Close()
+		close(closed)
+	}()
+
+	select {
+	case err := <-enqueued:
+		assert.ErrorIs(t, err, ErrDeleterClosed)
+	case <-time.After(time.Second):
+		t.Fatal("Close did not wake the waiting Enqueue")
+	}
+	close(st.release)
+	<-closed
+}
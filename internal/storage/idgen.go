@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/bits"
+	"strconv"
+)
+
+const (
+	base62Alphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+	// maxCodeAttempts bounds how many codes are tried for a single link before
+	// giving up, a taken code is retried with the next sequence number.
+	maxCodeAttempts = 10
+)
+
+var ErrNoFreeCode = errors.New("unable to find a free short code")
+
+// IDGenerator makes the short code of a new link. seq is the number the storage
+// gives the link anyway (row id or counter) and is never reused, so generators
+// built on a counter need no state of their own. Codes are not required to be
+// unique: the storage asks again with the next seq while a code is taken.
+type IDGenerator interface {
+	NewCode(seq int) (string, error)
+}
+
+// NewIDGenerator returns the generator of the given kind: decimal, base62,
+// random or hashids. length is the length of random codes and the minimal
+// length of hashids ones, salt is used by hashids only.
+func NewIDGenerator(kind string, length int, salt string) (IDGenerator, error) {
+	switch kind {
+	case "decimal":
+		return Decimal{}, nil
+	case "base62":
+		return Base62{}, nil
+	case "random":
+		if length < 1 {
+			return nil, fmt.Errorf("length of random codes must be positive, got %d", length)
+		}
+		return Random{Length: length}, nil
+	case "hashids":
+		return NewHashids(salt, length), nil
+	default:
+		return nil, fmt.Errorf("unknown ID generator %q, want one of: decimal, base62, random, hashids", kind)
+	}
+}
+
+// orDecimal lets storages be used without a generator set, links are then
+// numbered as they always were.
+func orDecimal(g IDGenerator) IDGenerator {
+	if g == nil {
+		return Decimal{}
+	}
+	return g
+}
+
+// fixedCode is an alias chosen by the user instead of a generated code. It
+// never changes, so once taken every retry fails with ErrNoFreeCode.
+type fixedCode string
+
+func (c fixedCode) NewCode(int) (string, error) {
+	return string(c), nil
+}
+
+// nextCode returns the first seq after last whose code is not taken yet.
+func nextCode(g IDGenerator, last int, taken func(code string) bool) (int, string, error) {
+	for attempt := 0; attempt < maxCodeAttempts; attempt++ {
+		last++
+		code, err := g.NewCode(last)
+		if err != nil {
+			return 0, "", err
+		}
+		if !taken(code) {
+			return last, code, nil
+		}
+	}
+	return 0, "", ErrNoFreeCode
+}
+
+// Decimal codes are the sequence numbers themselves, the only kind of links
+// there was before codes were introduced.
+type Decimal struct{}
+
+func (Decimal) NewCode(seq int) (string, error) {
+	return strconv.Itoa(seq), nil
+}
+
+// Base62 codes are the sequence numbers written with digits and latin letters.
+// They are short but still easy to enumerate.
+type Base62 struct{}
+
+func (Base62) NewCode(seq int) (string, error) {
+	return encode(uint64(seq), base62Alphabet, 1), nil
+}
+
+// Random codes are Length characters drawn from crypto/rand, 8 of them give
+// 62^8 (about 2*10^14) possible links.
+type Random struct {
+	Length int
+}
+
+func (r Random) NewCode(int) (string, error) {
+	code := make([]byte, 0, r.Length)
+	buf := make([]byte, r.Length)
+	for len(code) < r.Length {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for _, b := range buf {
+			// 248 = 4*62, taking bytes above it would make the first
+			// characters of the alphabet more likely
+			if b < 248 && len(code) < r.Length {
+				code = append(code, base62Alphabet[b%62])
+			}
+		}
+	}
+	return string(code), nil
+}
+
+// Hashids codes are sequence numbers spread over all codes of the same length
+// and written with an alphabet shuffled by the salt, like hashids do. Codes of
+// neighbouring links look unrelated, yet two links never get the same code.
+type Hashids struct {
+	alphabet  string
+	offset    uint64
+	minLength int
+}
+
+// hashidsFactor is coprime with 62, so multiplying by it modulo 62^n is a
+// permutation of all codes of length n.
+const hashidsFactor = 2147483647
+
+func NewHashids(salt string, minLength int) Hashids {
+	if minLength < 1 {
+		minLength = 1
+	}
+
+	alphabet := []byte(base62Alphabet)
+	if len(salt) > 0 {
+		// consistent shuffle of hashids
+		for i, v, p := len(alphabet)-1, 0, 0; i > 0; i-- {
+			v %= len(salt)
+			c := int(salt[v])
+			p += c
+			j := (c + v + p) % i
+			alphabet[i], alphabet[j] = alphabet[j], alphabet[i]
+			v++
+		}
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(salt))
+	return Hashids{alphabet: string(alphabet), offset: h.Sum64(), minLength: minLength}
+}
+
+func (h Hashids) NewCode(seq int) (string, error) {
+	length, space := h.minLength, pow62(h.minLength)
+	for space != 0 && uint64(seq) >= space {
+		length++
+		space = pow62(length)
+	}
+	if space == 0 {
+		return "", fmt.Errorf("sequence number %d is too big for hashids", seq)
+	}
+
+	hi, lo := bits.Mul64(uint64(seq), hashidsFactor)
+	n := (bits.Rem64(hi, lo, space) + h.offset%space) % space
+	return encode(n, h.alphabet, length), nil
+}
+
+// pow62 returns 62^n or 0 if it does not fit into uint64.
+func pow62(n int) uint64 {
+	result := uint64(1)
+	for i := 0; i < n; i++ {
+		hi, lo := bits.Mul64(result, 62)
+		if hi != 0 {
+			return 0
+		}
+		result = lo
+	}
+	return result
+}
+
+// encode writes n in the base of len(alphabet), padded to minLength.
+func encode(n uint64, alphabet string, minLength int) string {
+	base := uint64(len(alphabet))
+	var buf []byte
+	for n > 0 || len(buf) < minLength {
+		buf = append(buf, alphabet[n%base])
+		n /= base
+	}
+	for i, k := 0, len(buf)-1; i < k; i, k = i+1, k-1 {
+		buf[i], buf[k] = buf[k], buf[i]
+	}
+	return string(buf)
+}
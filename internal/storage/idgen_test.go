@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var codeRe = regexp.MustCompile(`^[0-9a-zA-Z]+$`)
+
+func TestCounterGeneratorsAreUnique(t *testing.T) {
+	for name, g := range map[string]IDGenerator{
+		"base62":  Base62{},
+		"hashids": NewHashids("salt", 2),
+	} {
+		t.Run(name, func(t *testing.T) {
+			seen := make(map[string]int)
+			// 62^2 codes of the minimal length of hashids and some longer ones
+			for seq := 1; seq < 10000; seq++ {
+				code, err := g.NewCode(seq)
+				require.NoError(t, err)
+				require.Regexp(t, codeRe, code)
+				if prev, found := seen[code]; found {
+					t.Fatalf("code %s is given to both %d and %d", code, prev, seq)
+				}
+				seen[code] = seq
+			}
+		})
+	}
+}
+
+func TestHashidsSalt(t *testing.T) {
+	a, err := NewHashids("one", 6).NewCode(1)
+	require.NoError(t, err)
+	b, err := NewHashids("two", 6).NewCode(1)
+	require.NoError(t, err)
+	next, err := NewHashids("one", 6).NewCode(2)
+	require.NoError(t, err)
+
+	assert.Len(t, a, 6)
+	assert.NotEqual(t, a, b, "codes must depend on the salt")
+	assert.NotEqual(t, a[:5], next[:5], "codes of neighbouring links must not look alike")
+}
+
+func TestRandom(t *testing.T) {
+	g := Random{Length: 8}
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		code, err := g.NewCode(1)
+		require.NoError(t, err)
+		require.Len(t, code, 8)
+		require.Regexp(t, codeRe, code)
+		require.False(t, seen[code])
+		seen[code] = true
+	}
+}
+
+func TestNewIDGenerator(t *testing.T) {
+	g, err := NewIDGenerator("decimal", 0, "")
+	require.NoError(t, err)
+	code, err := g.NewCode(42)
+	require.NoError(t, err)
+	assert.Equal(t, "42", code)
+
+	_, err = NewIDGenerator("random", 0, "")
+	assert.Error(t, err)
+	_, err = NewIDGenerator("uuid", 8, "")
+	assert.Error(t, err)
+}
+
+// takenFirst gives the code of the first stored link to every odd seq.
+type takenFirst struct{}
+
+func (takenFirst) NewCode(seq int) (string, error) {
+	if seq%2 == 1 {
+		return "1", nil
+	}
+	return Decimal{}.NewCode(seq)
+}
+
+type constant struct{}
+
+func (constant) NewCode(int) (string, error) {
+	return "same", nil
+}
+
+func TestCodeCollisions(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory("http://localhost:8080/")
+	m.IDs = takenFirst{}
+
+	first, err := m.AddURL(ctx, "https://github.com/", "u1", time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, "http://localhost:8080/1", first)
+
+	shortURLs, err := m.AddURLBatch(ctx, []string{"https://ya.ru/", "https://google.com/"}, "u1", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"http://localhost:8080/2", "http://localhost:8080/4"}, shortURLs)
+
+	m.IDs = constant{}
+	_, err = m.AddURL(ctx, "https://go.dev/", "u1", time.Time{})
+	require.NoError(t, err)
+	_, err = m.AddURL(ctx, "https://pkg.go.dev/", "u1", time.Time{})
+	assert.ErrorIs(t, err, ErrNoFreeCode)
+	_, err = m.AddURLBatch(ctx, []string{"https://golang.org/", "https://play.golang.org/"}, "u1", nil)
+	assert.ErrorIs(t, err, ErrNoFreeCode)
+	_, err = m.SearchURL(ctx, "same")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Janitor marks expired links of storage as deleted every interval. Expired
+// links are already gone for readers before that, the janitor keeps them from
+// being stored as live ones forever.
+type Janitor struct {
+	storage  Storage
+	interval time.Duration
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewJanitor(st Storage, interval time.Duration) *Janitor {
+	j := &Janitor{
+		storage:  st,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+
+	j.wg.Add(1)
+	go j.run()
+	return j
+}
+
+// Close stops the janitor and waits for the current purge to finish.
+func (j *Janitor) Close() {
+	close(j.stop)
+	j.wg.Wait()
+}
+
+func (j *Janitor) run() {
+	defer j.wg.Done()
+
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			j.purge()
+		case <-j.stop:
+			return
+		}
+	}
+}
+
+func (j *Janitor) purge() {
+	ctx, cancel := context.WithTimeout(context.Background(), j.interval)
+	defer cancel()
+
+	count, err := j.storage.ExpireURLs(ctx, time.Now())
+	if err != nil {
+		log.Println("unable to expire urls", err)
+		return
+	}
+	if count > 0 {
+		log.Println("expired urls:", count)
+	}
+}
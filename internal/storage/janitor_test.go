@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	middleware "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/middleware"
+)
+
+func TestJanitor(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory("http://localhost:8080/")
+
+	_, err := m.AddURL(ctx, "https://github.com/", "u1", time.Now().Add(-time.Second))
+	require.NoError(t, err)
+	_, err = m.AddURL(ctx, "https://ya.ru/", "u1", time.Now().Add(time.Hour))
+	require.NoError(t, err)
+
+	j := NewJanitor(m, 10*time.Millisecond)
+	defer j.Close()
+
+	assert.Eventually(t, func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.Deleted[1]
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = m.SearchURL(ctx, "2")
+	assert.NoError(t, err)
+	_, err = m.SearchURL(ctx, "1")
+	assert.ErrorIs(t, err, middleware.ErrGone)
+}
@@ -0,0 +1,307 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	middleware "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/middleware"
+)
+
+type SyncPolicy string
+
+const (
+	SyncAlways   SyncPolicy = "always"
+	SyncInterval SyncPolicy = "interval"
+	SyncNever    SyncPolicy = "never"
+)
+
+func ParseSyncPolicy(policy string) (SyncPolicy, error) {
+	switch p := SyncPolicy(policy); p {
+	case SyncAlways, SyncInterval, SyncNever:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown sync policy %q, want one of: always, interval, never", policy)
+	}
+}
+
+// Journal is an append-only file of JSON lines, one middleware.JSONStruct per
+// line. A later line for the same ShortenURL replaces the earlier one, so
+// updates (e.g. deletion) are appended as well and old lines are dropped only
+// by Compact.
+type Journal struct {
+	*appender
+}
+
+// appender is an append-only file of lines, the part Journal shares with the
+// clicks file of File.
+type appender struct {
+	path   string
+	policy SyncPolicy
+
+	mu    sync.Mutex
+	file  *os.File
+	size  int64
+	lines int
+	dirty bool
+}
+
+// OpenJournal replays the journal at path and opens it for appending. A torn
+// last line left by a crash is cut off. A file in the old format (a single JSON
+// array) is loaded as well and rewritten as a journal right away.
+func OpenJournal(path string, policy SyncPolicy) (*Journal, []middleware.JSONStruct, error) {
+	j := &Journal{&appender{path: path, policy: policy}}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, err
+	}
+
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var entries []middleware.JSONStruct
+		if err := json.Unmarshal(trimmed, &entries); err != nil {
+			return nil, nil, fmt.Errorf("read %s as JSON array: %w", path, err)
+		}
+		log.Println("file", path, "is in the old JSON array format, converting to journal")
+		if err := j.Compact(entries); err != nil {
+			return nil, nil, err
+		}
+		return j, entries, nil
+	}
+
+	entries, valid, lines, err := replay(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read journal %s: %w", path, err)
+	}
+
+	j.appender, err = openAppender(path, policy, data, valid, lines)
+	if err != nil {
+		return nil, nil, err
+	}
+	return j, entries, nil
+}
+
+// openAppender opens path for appending. Its first valid bytes of data hold
+// lines complete lines, the rest is a torn last line left by a crash and is
+// cut off.
+func openAppender(path string, policy SyncPolicy, data []byte, valid int64, lines int) (*appender, error) {
+	if valid < int64(len(data)) {
+		log.Printf("file %s has a torn last line, dropping %d bytes", path, int64(len(data))-valid)
+		if err := os.Truncate(path, valid); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	a := &appender{path: path, policy: policy, file: file, size: valid, lines: lines}
+
+	// the last line is complete but lost its newline, the next append
+	// must not be glued to it
+	if valid > 0 && data[valid-1] != '\n' {
+		if _, err := file.Write([]byte{'\n'}); err != nil {
+			file.Close()
+			return nil, err
+		}
+		a.size++
+	}
+	return a, nil
+}
+
+// replay returns the latest state of every entry ordered by ShortenURL and the
+// length of the data that holds complete lines only.
+func replay(data []byte) ([]middleware.JSONStruct, int64, int, error) {
+	var (
+		byID   = make(map[int]middleware.JSONStruct)
+		offset int64
+		lines  int
+	)
+
+	for len(data) > 0 {
+		line := data
+		next := bytes.IndexByte(data, '\n')
+		if next >= 0 {
+			line = data[:next]
+		}
+
+		var entry middleware.JSONStruct
+		if err := json.Unmarshal(line, &entry); err != nil {
+			if next < 0 {
+				// the last line was not written completely
+				break
+			}
+			if len(bytes.TrimSpace(line)) > 0 {
+				return nil, 0, 0, fmt.Errorf("line %d: %w", lines+1, err)
+			}
+		} else {
+			byID[entry.ShortenURL] = entry
+		}
+
+		if next < 0 {
+			offset += int64(len(data))
+			lines++
+			break
+		}
+		offset += int64(next + 1)
+		lines++
+		data = data[next+1:]
+	}
+
+	entries := make([]middleware.JSONStruct, 0, len(byID))
+	for _, entry := range byID {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, k int) bool { return entries[i].ShortenURL < entries[k].ShortenURL })
+	return entries, offset, lines, nil
+}
+
+func marshalLines(entries []middleware.JSONStruct) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// Append writes entries with a single write call. If the write or, with
+// SyncAlways, the sync fails, the file is cut back, so a failed append never
+// leaves garbage before the next one nor a record the caller gave up on.
+func (j *Journal) Append(entries ...middleware.JSONStruct) error {
+	data, err := marshalLines(entries)
+	if err != nil {
+		return err
+	}
+	return j.write(data, len(entries))
+}
+
+// write appends data holding lines lines, see Journal.Append.
+func (a *appender) write(data []byte, lines int) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// requests outliving the shutdown timeout may still write
+	if a.file == nil {
+		return os.ErrClosed
+	}
+	_, err := a.file.Write(data)
+	if err == nil && a.policy == SyncAlways {
+		err = a.file.Sync()
+	}
+	if err != nil {
+		if truncErr := a.file.Truncate(a.size); truncErr != nil {
+			log.Println("unable to cut back file", a.path, truncErr)
+		}
+		return err
+	}
+	a.size += int64(len(data))
+	a.lines += lines
+	a.dirty = a.policy != SyncAlways
+	return nil
+}
+
+// Sync flushes appended data to disk if there is any.
+func (a *appender) Sync() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.dirty || a.file == nil {
+		return nil
+	}
+	a.dirty = false
+	return a.file.Sync()
+}
+
+// Lines is the number of lines in the file including replaced ones.
+func (a *appender) Lines() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.lines
+}
+
+// Compact replaces the journal with exactly one line per entry. The new file
+// is written aside and renamed over the old one, so a crash in the middle
+// leaves the old journal in place.
+func (j *Journal) Compact(entries []middleware.JSONStruct) error {
+	data, err := marshalLines(entries)
+	if err != nil {
+		return err
+	}
+	return j.replace(data, len(entries))
+}
+
+// replace swaps the file for data holding lines lines, see Journal.Compact.
+func (a *appender) replace(data []byte, lines int) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := replaceFile(a.path, a.path+".compact", data, 0644); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if a.file != nil {
+		a.file.Close()
+	}
+	a.file = file
+	a.size = int64(len(data))
+	a.lines = lines
+	a.dirty = false
+	return nil
+}
+
+// replaceFile writes data to tmpPath and renames it over path, so readers and
+// a crash in the middle see either the old content or the new one.
+func replaceFile(path string, tmpPath string, data []byte, perm os.FileMode) error {
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+func (a *appender) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Sync()
+	if closeErr := a.file.Close(); err == nil {
+		err = closeErr
+	}
+	a.file = nil
+	return err
+}
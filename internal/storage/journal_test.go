@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	middleware "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournalTornLastLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+	require.NoError(t, os.WriteFile(path, []byte(
+		`{"fullURL":"https://github.com/","shortenURL":1,"user":"u1"}`+"\n"+
+			`{"fullURL":"https://ya.ru/","shortenURL":2,"user":"u1"}`+"\n"+
+			`{"fullURL":"https://github.com/","shortenURL":1,"user":"u1","deleted":true}`+"\n"+
+			`{"fullURL":"https://goo`), 0644))
+
+	j, entries, err := OpenJournal(path, SyncAlways)
+	require.NoError(t, err)
+	assert.Equal(t, []middleware.JSONStruct{
+		{FullURL: "https://github.com/", ShortenURL: 1, User: "u1", Deleted: true},
+		{FullURL: "https://ya.ru/", ShortenURL: 2, User: "u1"},
+	}, entries)
+
+	require.NoError(t, j.Append(middleware.JSONStruct{FullURL: "https://google.com/", ShortenURL: 3, User: "u2"}))
+	require.NoError(t, j.Close())
+	assert.ErrorIs(t, j.Append(middleware.JSONStruct{FullURL: "https://lost.com/", ShortenURL: 4}), os.ErrClosed)
+
+	j, entries, err = OpenJournal(path, SyncAlways)
+	require.NoError(t, err)
+	assert.Len(t, entries, 3)
+	assert.Equal(t, 4, j.Lines())
+
+	require.NoError(t, j.Compact(entries))
+	assert.Equal(t, 3, j.Lines())
+	require.NoError(t, j.Close())
+
+	_, compacted, err := OpenJournal(path, SyncAlways)
+	require.NoError(t, err)
+	assert.Equal(t, entries, compacted)
+}
+
+func TestJournalOldArrayFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+	require.NoError(t, os.WriteFile(path, []byte(
+		`[{"fullURL":"https://github.com/","shortenURL":1,"user":"u1"},`+
+			`{"fullURL":"https://ya.ru/","shortenURL":2,"user":"u2"}]`), 0644))
+
+	f, err := NewFile("http://localhost:8080/", path, FileConfig{Sync: SyncAlways})
+	require.NoError(t, err)
+	assert.Equal(t, 2, f.ID)
+	url, err := f.SearchURL(context.Background(), "2")
+	require.NoError(t, err)
+	assert.Equal(t, "https://ya.ru/", url)
+	require.NoError(t, f.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t,
+		`{"fullURL":"https://github.com/","shortenURL":1,"user":"u1"}`+"\n"+
+			`{"fullURL":"https://ya.ru/","shortenURL":2,"user":"u2"}`+"\n", string(data))
+}
@@ -0,0 +1,724 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/pressly/goose/v3"
+	middleware "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/middleware"
+)
+
+//SQLITE PART//
+
+// SQLiteDSN tells whether dsn points to an SQLite database (sqlite://path or
+// file:path) and returns the data source name for the sqlite3 driver.
+func SQLiteDSN(dsn string) (string, bool) {
+	switch {
+	case strings.HasPrefix(dsn, "sqlite://"):
+		return strings.TrimPrefix(dsn, "sqlite://"), true
+	case strings.HasPrefix(dsn, "file:"):
+		return dsn, true
+	default:
+		return "", false
+	}
+}
+
+type SQLite struct {
+	BaseURL string
+	IDs     IDGenerator
+	Timeout time.Duration
+	DB      *sql.DB
+}
+
+func NewSQLite(baseURL string, dsn string, timeout time.Duration) (*SQLite, error) {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows only one writer at a time, a single connection queues
+	// writers in the pool instead of failing them with SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+
+	return &SQLite{BaseURL: baseURL, Timeout: timeout, DB: db}, nil
+}
+
+// Migrate applies goose migrations from dir written in SQLite dialect.
+func (sl *SQLite) Migrate(dir string) error {
+	if err := goose.SetDialect("sqlite3"); err != nil {
+		return err
+	}
+	return goose.Up(sl.DB, dir)
+}
+
+func (sl *SQLite) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if sl.Timeout > 0 {
+		return context.WithTimeout(ctx, sl.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+type sqlQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// addURL returns the code of url and whether it was inserted just now. A taken
+// code is tried again with the next id, like nextCode does.
+func (sl *SQLite) addURL(ctx context.Context, q sqlQueryer, g IDGenerator, url string, user string,
+	expiresAt int64) (string, bool, error) {
+
+	var lastID int
+
+	// an expired link the janitor has not marked yet must not hold its url
+	_, err := q.ExecContext(ctx, "UPDATE storage SET is_deleted = true WHERE full_url = $1 AND is_deleted = false "+
+		"AND expires_at <= $2", url, time.Now().Unix())
+	if err != nil {
+		return "", false, err
+	}
+
+	for attempt := 0; attempt < maxCodeAttempts; attempt++ {
+		var maxID int
+		if err := q.QueryRowContext(ctx, "SELECT COALESCE(MAX(id), 0) FROM storage").Scan(&maxID); err != nil {
+			return "", false, err
+		}
+		if maxID > lastID {
+			lastID = maxID
+		}
+		lastID++
+
+		code, err := g.NewCode(lastID)
+		if err != nil {
+			return "", false, err
+		}
+
+		// without a conflict target a taken url and a taken code are both
+		// skipped, the lookup by url below tells one from the other
+		var id int64
+		err = q.QueryRowContext(ctx, "INSERT INTO storage (id, code, full_url, user_id, expires_at) "+
+			"VALUES ($1, $2, $3, $4, NULLIF($5, 0)) ON CONFLICT DO NOTHING RETURNING id",
+			lastID, code, url, user, expiresAt).Scan(&id)
+		if err == nil {
+			return code, true, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return "", false, err
+		}
+
+		var existing string
+		err = q.QueryRowContext(ctx, "SELECT code FROM storage WHERE full_url = $1 AND is_deleted = false", url).
+			Scan(&existing)
+		if err == nil {
+			return existing, false, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return "", false, err
+		}
+	}
+	return "", false, ErrNoFreeCode
+}
+
+func (sl *SQLite) AddURL(ctx context.Context, url string, user string, expiresAt time.Time) (string, error) {
+	ctx, cancel := sl.withTimeout(ctx)
+	defer cancel()
+
+	code, inserted, err := sl.addURL(ctx, sl.DB, orDecimal(sl.IDs), url, user, unixTime(expiresAt))
+	if err != nil {
+		return "", err
+	}
+	if !inserted {
+		return sl.BaseURL + code, middleware.NewStorageError(middleware.ErrConflict, "409")
+	}
+	return sl.BaseURL + code, nil
+}
+
+func (sl *SQLite) AddURLAlias(ctx context.Context, url string, alias string, user string,
+	expiresAt time.Time) (string, error) {
+
+	var (
+		existingURL, owner string
+		isDeleted          bool
+		existingExpiry     int64
+	)
+
+	ctx, cancel := sl.withTimeout(ctx)
+	defer cancel()
+
+	err := sl.DB.QueryRowContext(ctx,
+		"SELECT full_url, COALESCE(user_id, ''), is_deleted, COALESCE(expires_at, 0) FROM storage WHERE code = $1", alias).
+		Scan(&existingURL, &owner, &isDeleted, &existingExpiry)
+	if err == nil {
+		if existingURL == url && owner == user && !isDeleted && !expired(existingExpiry, time.Now()) {
+			return sl.BaseURL + alias, nil
+		}
+		return "", middleware.NewStorageError(middleware.ErrAliasTaken, "409")
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+
+	code, inserted, err := sl.addURL(ctx, sl.DB, fixedCode(alias), url, user, unixTime(expiresAt))
+	if errors.Is(err, ErrNoFreeCode) {
+		// taken by a concurrent request right after the check above
+		return "", middleware.NewStorageError(middleware.ErrAliasTaken, "409")
+	} else if err != nil {
+		return "", err
+	}
+	if !inserted {
+		return sl.BaseURL + code, middleware.NewStorageError(middleware.ErrConflict, "409")
+	}
+	return sl.BaseURL + code, nil
+}
+
+func (sl *SQLite) AddURLBatch(ctx context.Context, urls []string, user string, expiresAt []time.Time) ([]string, error) {
+	var conflictErr error
+
+	ctx, cancel := sl.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := sl.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	shortURLs := make([]string, len(urls))
+	for i, url := range urls {
+		code, inserted, err := sl.addURL(ctx, tx, orDecimal(sl.IDs), url, user, batchExpiry(expiresAt, i))
+		if err != nil {
+			return nil, err
+		}
+		if !inserted {
+			conflictErr = middleware.NewStorageError(middleware.ErrConflict, "409")
+		}
+		shortURLs[i] = sl.BaseURL + code
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return shortURLs, conflictErr
+}
+
+func (sl *SQLite) SearchURL(ctx context.Context, code string) (string, error) {
+	var (
+		url       string
+		isDeleted bool
+		expiresAt int64
+	)
+
+	ctx, cancel := sl.withTimeout(ctx)
+	defer cancel()
+
+	err := sl.DB.QueryRowContext(ctx, "SELECT full_url, is_deleted, COALESCE(expires_at, 0) FROM storage WHERE code = $1", code).
+		Scan(&url, &isDeleted, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", middleware.ErrNotFound
+	} else if err != nil {
+		return "", err
+	}
+
+	if isDeleted || expired(expiresAt, time.Now()) {
+		return url, middleware.ErrGone
+	}
+	return url, nil
+}
+
+func (sl *SQLite) GetAllURLForUser(ctx context.Context, user string) ([]middleware.JSONStructForAuth, error) {
+	var (
+		JSONStructList []middleware.JSONStructForAuth
+		JSONStruct     middleware.JSONStructForAuth
+	)
+
+	ctx, cancel := sl.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := sl.DB.QueryContext(ctx,
+		"SELECT code, full_url FROM storage WHERE user_id = $1 AND is_deleted = false "+
+			"AND (expires_at IS NULL OR expires_at > $2) ORDER BY id", user, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code, &JSONStruct.OriginalURL); err != nil {
+			return nil, err
+		}
+
+		JSONStruct.ShortURL = sl.BaseURL + code
+		JSONStructList = append(JSONStructList, JSONStruct)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(JSONStructList) == 0 {
+		return JSONStructList, middleware.ErrNoContent
+	}
+	return JSONStructList, nil
+}
+
+func (sl *SQLite) GetStats(ctx context.Context) (middleware.JSONStats, error) {
+	var stats middleware.JSONStats
+
+	ctx, cancel := sl.withTimeout(ctx)
+	defer cancel()
+
+	err := sl.DB.QueryRowContext(ctx, "SELECT COUNT(*), COUNT(DISTINCT NULLIF(user_id, '')) FROM storage").
+		Scan(&stats.URLs, &stats.Users)
+	return stats, err
+}
+
+func (sl *SQLite) DeleteURLs(ctx context.Context, codes []string, user string) error {
+	_, err := sl.execChunked(ctx, "UPDATE storage SET is_deleted = true WHERE user_id = $1 AND code IN (%s)",
+		[]interface{}{user}, codes)
+	return err
+}
+
+// sqliteMaxCodes keeps IN lists below SQLITE_MAX_VARIABLE_NUMBER, which is
+// only 999 in SQLite before 3.32.
+const sqliteMaxCodes = 500
+
+// execChunked runs query, whose %s is an IN list of values, for at most
+// sqliteMaxCodes values at a time in a single transaction and returns the
+// number of affected rows. SQLite has no arrays, so every value gets its own
+// placeholder after those of args.
+func (sl *SQLite) execChunked(ctx context.Context, query string, args []interface{}, values []string) (int64, error) {
+	if len(values) == 0 {
+		return 0, nil
+	}
+
+	ctx, cancel := sl.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := sl.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var count int64
+	for len(values) > 0 {
+		chunk := values
+		if len(chunk) > sqliteMaxCodes {
+			chunk = chunk[:sqliteMaxCodes]
+		}
+		values = values[len(chunk):]
+
+		chunkArgs := make([]interface{}, 0, len(args)+len(chunk))
+		chunkArgs = append(chunkArgs, args...)
+		placeholders := make([]string, len(chunk))
+		for i, value := range chunk {
+			chunkArgs = append(chunkArgs, value)
+			placeholders[i] = "$" + strconv.Itoa(len(args)+i+1)
+		}
+
+		res, err := tx.ExecContext(ctx, fmt.Sprintf(query, strings.Join(placeholders, ", ")), chunkArgs...)
+		if err != nil {
+			return 0, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		count += n
+	}
+	return count, tx.Commit()
+}
+
+func (sl *SQLite) DisableURLs(ctx context.Context, codes []string) (int, error) {
+	count, err := sl.execChunked(ctx, "UPDATE storage SET is_deleted = true WHERE is_deleted = false AND code IN (%s)",
+		nil, codes)
+	return int(count), err
+}
+
+func (sl *SQLite) Export(ctx context.Context, fn func(middleware.JSONStruct) error) error {
+	rows, err := sl.DB.QueryContext(ctx,
+		"SELECT id, code, full_url, COALESCE(user_id, ''), is_deleted, COALESCE(expires_at, 0) FROM storage ORDER BY id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var record middleware.JSONStruct
+		if err := rows.Scan(&record.ShortenURL, &record.Code, &record.FullURL, &record.User, &record.Deleted, &record.ExpiresAt); err != nil {
+			return err
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Import relies on AUTOINCREMENT, which keeps its sequence past explicitly set
+// ids by itself.
+func (sl *SQLite) Import(ctx context.Context, records []middleware.JSONStruct) error {
+	ctx, cancel := sl.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := sl.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, r := range records {
+		_, err := tx.ExecContext(ctx, "INSERT INTO storage (id, code, full_url, user_id, is_deleted, expires_at) "+
+			"VALUES ($1, $2, $3, $4, $5, NULLIF($6, 0)) ON CONFLICT (id) DO NOTHING",
+			r.ShortenURL, codeOf(r), r.FullURL, r.User, r.Deleted, r.ExpiresAt)
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+			return middleware.NewStorageError(middleware.ErrConflict,
+				fmt.Sprintf("409 url %s or code %s is already stored with another ID", r.FullURL, codeOf(r)))
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (sl *SQLite) ExpireURLs(ctx context.Context, now time.Time) (int, error) {
+	ctx, cancel := sl.withTimeout(ctx)
+	defer cancel()
+
+	res, err := sl.DB.ExecContext(ctx,
+		"UPDATE storage SET is_deleted = true WHERE is_deleted = false AND expires_at <= $1", now.Unix())
+	if err != nil {
+		return 0, err
+	}
+	count, err := res.RowsAffected()
+	return int(count), err
+}
+
+// NormalizeURLs goes through live links by ID in batches, like
+// Database.NormalizeURLs.
+func (sl *SQLite) NormalizeURLs(ctx context.Context, normalize func(string) (string, error)) (int, error) {
+	var count, after int
+	for {
+		changes, last, err := sl.normalBatch(ctx, after, normalize)
+		if err != nil || last == 0 {
+			return count, err
+		}
+		replaced, err := sl.replaceURLs(ctx, changes)
+		count += replaced
+		if err != nil {
+			return count, err
+		}
+		after = last
+	}
+}
+
+func (sl *SQLite) normalBatch(ctx context.Context, after int, normalize func(string) (string, error)) (
+	[]urlChange, int, error) {
+
+	var (
+		changes []urlChange
+		last    int
+	)
+
+	ctx, cancel := sl.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := sl.DB.QueryContext(ctx,
+		"SELECT id, full_url FROM storage WHERE id > $1 AND is_deleted = false ORDER BY id LIMIT $2",
+		after, normalizeBatchSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&last, &url); err != nil {
+			return nil, 0, err
+		}
+		if normal, err := normalize(url); err == nil && normal != url {
+			changes = append(changes, urlChange{ID: last, URL: normal})
+		}
+	}
+	return changes, last, rows.Err()
+}
+
+func (sl *SQLite) replaceURLs(ctx context.Context, changes []urlChange) (int, error) {
+	if len(changes) == 0 {
+		return 0, nil
+	}
+
+	ctx, cancel := sl.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := sl.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var replaced int
+	for _, c := range changes {
+		// a link holding the normal form already keeps it
+		res, err := tx.ExecContext(ctx, "UPDATE storage SET full_url = $1 WHERE id = $2 "+
+			"AND NOT EXISTS (SELECT 1 FROM storage WHERE full_url = $1 AND is_deleted = false)", c.URL, c.ID)
+		if err != nil {
+			return 0, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		replaced += int(n)
+	}
+	return replaced, tx.Commit()
+}
+
+func (sl *SQLite) AddClicks(ctx context.Context, clicks []Click) error {
+	ctx, cancel := sl.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := sl.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// clicks are selected from storage, so clicks of unknown codes are skipped.
+	// SQLite binds $n in the order they appear, so code goes last.
+	for _, c := range clicks {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO clicks (code, clicked_at, referrer, user_agent, ip_hash) "+
+			"SELECT code, $1, $2, $3, $4 FROM storage WHERE code = $5",
+			c.Time.Unix(), c.Referrer, c.UserAgent, c.IPHash, c.Code); err != nil {
+			return err
+		}
+	}
+	for key, n := range aggregateClicks(clicks) {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO click_buckets (code, period, started_at, clicks) "+
+			"SELECT code, $1, $2, $3 FROM storage WHERE code = $4 "+
+			"ON CONFLICT (code, period, started_at) DO UPDATE SET clicks = clicks + excluded.clicks",
+			key.Period, key.Start, n, key.Code); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (sl *SQLite) ExportClicks(ctx context.Context, fn func(ClickCounter) error) error {
+	rows, err := sl.DB.QueryContext(ctx,
+		"SELECT code, started_at, clicks FROM click_buckets WHERE period = $1 ORDER BY code, started_at", periodHour)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c ClickCounter
+		if err := rows.Scan(&c.Code, &c.Start, &c.Clicks); err != nil {
+			return err
+		}
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (sl *SQLite) ImportClicks(ctx context.Context, counters []ClickCounter) error {
+	ctx, cancel := sl.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := sl.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, c := range counters {
+		hour, day := bucketStarts(time.Unix(c.Start, 0))
+		res, err := tx.ExecContext(ctx, "INSERT INTO click_buckets (code, period, started_at, clicks) "+
+			"SELECT code, $1, $2, $3 FROM storage WHERE code = $4 ON CONFLICT (code, period, started_at) DO NOTHING",
+			periodHour, hour, c.Clicks, c.Code)
+		if err != nil {
+			return err
+		}
+		inserted, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		// the day gets the clicks of the hour only if the hour was not there yet
+		if inserted == 0 {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO click_buckets (code, period, started_at, clicks) "+
+			"VALUES ($1, $2, $3, $4) ON CONFLICT (code, period, started_at) DO UPDATE SET clicks = clicks + excluded.clicks",
+			c.Code, periodDay, day, c.Clicks); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (sl *SQLite) LinkStats(ctx context.Context, code string, user string) (LinkStats, error) {
+	var (
+		owner  string
+		hourly []ClickBucket
+		daily  []ClickBucket
+	)
+
+	ctx, cancel := sl.withTimeout(ctx)
+	defer cancel()
+
+	err := sl.DB.QueryRowContext(ctx, "SELECT COALESCE(user_id, '') FROM storage WHERE code = $1", code).Scan(&owner)
+	if errors.Is(err, sql.ErrNoRows) {
+		return LinkStats{}, middleware.ErrNotFound
+	} else if err != nil {
+		return LinkStats{}, err
+	}
+	if owner != user {
+		return LinkStats{}, middleware.ErrForbidden
+	}
+
+	rows, err := sl.DB.QueryContext(ctx, "SELECT period, started_at, clicks FROM click_buckets WHERE code = $1", code)
+	if err != nil {
+		return LinkStats{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			period string
+			start  int64
+			clicks int64
+		)
+		if err := rows.Scan(&period, &start, &clicks); err != nil {
+			return LinkStats{}, err
+		}
+		bucket := ClickBucket{Start: time.Unix(start, 0).UTC(), Clicks: clicks}
+		if period == periodHour {
+			hourly = append(hourly, bucket)
+		} else {
+			daily = append(daily, bucket)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return LinkStats{}, err
+	}
+	return newLinkStats(code, hourly, daily), nil
+}
+
+func (sl *SQLite) AddAPIKey(ctx context.Context, key APIKey) error {
+	ctx, cancel := sl.withTimeout(ctx)
+	defer cancel()
+
+	_, err := sl.DB.ExecContext(ctx, "INSERT INTO api_keys (id, user_id, name, hash, created_at) VALUES ($1, $2, $3, $4, $5)",
+		key.ID, key.User, key.Name, key.Hash, key.CreatedAt.Unix())
+	return err
+}
+
+func (sl *SQLite) GetAPIKeys(ctx context.Context, user string) ([]APIKey, error) {
+	var keys []APIKey
+
+	ctx, cancel := sl.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := sl.DB.QueryContext(ctx,
+		"SELECT id, user_id, name, hash, created_at FROM api_keys WHERE user_id = $1 ORDER BY created_at, id", user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			key       APIKey
+			createdAt int64
+		)
+		if err := rows.Scan(&key.ID, &key.User, &key.Name, &key.Hash, &createdAt); err != nil {
+			return nil, err
+		}
+		key.CreatedAt = time.Unix(createdAt, 0)
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (sl *SQLite) DeleteAPIKeys(ctx context.Context, ids []string, user string) error {
+	_, err := sl.execChunked(ctx, "DELETE FROM api_keys WHERE user_id = $1 AND id IN (%s)", []interface{}{user}, ids)
+	return err
+}
+
+func (sl *SQLite) UserByAPIKey(ctx context.Context, hash string) (string, error) {
+	var user string
+
+	ctx, cancel := sl.withTimeout(ctx)
+	defer cancel()
+
+	err := sl.DB.QueryRowContext(ctx, "SELECT user_id FROM api_keys WHERE hash = $1", hash).Scan(&user)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", middleware.ErrNotFound
+	}
+	return user, err
+}
+
+func (sl *SQLite) ExportAPIKeys(ctx context.Context, fn func(APIKey) error) error {
+	rows, err := sl.DB.QueryContext(ctx, "SELECT id, user_id, name, hash, created_at FROM api_keys ORDER BY created_at, id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			key       APIKey
+			createdAt int64
+		)
+		if err := rows.Scan(&key.ID, &key.User, &key.Name, &key.Hash, &createdAt); err != nil {
+			return err
+		}
+		key.CreatedAt = time.Unix(createdAt, 0)
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (sl *SQLite) ImportAPIKeys(ctx context.Context, keys []APIKey) error {
+	ctx, cancel := sl.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := sl.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, key := range keys {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO api_keys (id, user_id, name, hash, created_at) "+
+			"VALUES ($1, $2, $3, $4, $5) ON CONFLICT DO NOTHING",
+			key.ID, key.User, key.Name, key.Hash, key.CreatedAt.Unix()); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (sl *SQLite) Ping(ctx context.Context) error {
+	ctx, cancel := sl.withTimeout(ctx)
+	defer cancel()
+
+	return sl.DB.PingContext(ctx)
+}
+
+func (sl *SQLite) Close() error {
+	return sl.DB.Close()
+}
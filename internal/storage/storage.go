@@ -2,316 +2,2158 @@ package storage
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
-	"os"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	middleware "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/middleware"
 )
 
-const (
-	schema = "public"
-	table  = "storage"
-)
-
+// Links with a zero expiresAt never expire. An already stored url keeps the
+// expiry it was stored with.
 type Storage interface {
-	AddURL(url string, user string) (string, error)
-	SearchURL(id int) (string, error)
-	GetAllURLForUser(user string) ([]middleware.JSONStructForAuth, error)
-	Ping() error
+	AddURL(ctx context.Context, url string, user string, expiresAt time.Time) (string, error)
+	// AddURLBatch stores all urls at once and returns their short links in the
+	// same order. Already stored urls are not an error for the batch: their
+	// existing links are returned in place and the result comes together with a
+	// 409 StorageError. Any other error means that nothing was stored.
+	// expiresAt is either nil or holds the expiry of every url.
+	AddURLBatch(ctx context.Context, urls []string, user string, expiresAt []time.Time) ([]string, error)
+	// AddURLAlias stores url under the code alias chosen by user. A url stored
+	// before is a 409 StorageError with its existing link, as for AddURL. An
+	// alias used by another link is a 409 StorageError of ErrAliasTaken, while
+	// the same user asking for the same url and alias again gets the link as
+	// long as it works. A deleted or expired alias is never handed out again.
+	AddURLAlias(ctx context.Context, url string, alias string, user string, expiresAt time.Time) (string, error)
+	// SearchURL returns ErrGone for deleted and expired links.
+	SearchURL(ctx context.Context, code string) (string, error)
+	GetAllURLForUser(ctx context.Context, user string) ([]middleware.JSONStructForAuth, error)
+	DeleteURLs(ctx context.Context, codes []string, user string) error
+	// DisableURLs marks links with codes as deleted whoever made them and
+	// returns how many were not deleted before.
+	DisableURLs(ctx context.Context, codes []string) (int, error)
+	// Export calls fn for every stored record, deleted ones included, in the
+	// order of their IDs.
+	Export(ctx context.Context, fn func(middleware.JSONStruct) error) error
+	// Import stores records under their own IDs and codes, so already shared
+	// short links keep working, and moves the ID sequence past them. Records
+	// without a code get their decimal ID, as links made before codes did.
+	// Records whose ID is already used are skipped. A URL or a code stored
+	// under another ID is a 409 StorageError and then nothing is imported.
+	Import(ctx context.Context, records []middleware.JSONStruct) error
+	// ExpireURLs marks links expired by now as deleted and returns how many
+	// of them there were.
+	ExpireURLs(ctx context.Context, now time.Time) (int, error)
+	// NormalizeURLs replaces urls of links that are not deleted by what
+	// normalize makes of them, so urls stored before normalization are found
+	// in their normal form as well. A url normalize rejects, or whose normal
+	// form another such link holds already, is left as it is. It returns how
+	// many urls were replaced.
+	NormalizeURLs(ctx context.Context, normalize func(string) (string, error)) (int, error)
+	// AddClicks adds clicks to the hourly and daily counters of their links.
+	// Clicks of codes that are not stored are skipped.
+	AddClicks(ctx context.Context, clicks []Click) error
+	// ExportClicks calls fn for every hourly click counter ordered by code and
+	// hour. Raw clicks are not exported, the stats are made of the counters.
+	ExportClicks(ctx context.Context, fn func(ClickCounter) error) error
+	// ImportClicks adds hourly counters to their links and their days.
+	// Counters of codes that are not stored and of hours their link has a
+	// counter for already are skipped, so an import may be repeated.
+	ImportClicks(ctx context.Context, counters []ClickCounter) error
+	// LinkStats returns the click counters of the link with code: ErrNotFound
+	// if there is no such link and ErrForbidden if it belongs to another user.
+	LinkStats(ctx context.Context, code string, user string) (LinkStats, error)
+	// GetStats counts all stored links, deleted and expired ones included, and
+	// the distinct users who made them.
+	GetStats(ctx context.Context) (middleware.JSONStats, error)
+	AddAPIKey(ctx context.Context, key APIKey) error
+	// GetAPIKeys returns keys of user in the order they were made.
+	GetAPIKeys(ctx context.Context, user string) ([]APIKey, error)
+	// DeleteAPIKeys removes keys of user with ids, ids of other users' keys
+	// are skipped.
+	DeleteAPIKeys(ctx context.Context, ids []string, user string) error
+	// UserByAPIKey returns the user of the key with hash or ErrNotFound.
+	UserByAPIKey(ctx context.Context, hash string) (string, error)
+	// ExportAPIKeys calls fn for the keys of all users in the order they were
+	// made.
+	ExportAPIKeys(ctx context.Context, fn func(APIKey) error) error
+	// ImportAPIKeys stores keys as they are, keys whose ID or hash is stored
+	// already are skipped.
+	ImportAPIKeys(ctx context.Context, keys []APIKey) error
+	Ping(ctx context.Context) error
+	// Close writes out what is buffered and releases files and connections.
+	// It is called once workers using the storage are stopped, repeated
+	// calls do nothing.
+	Close() error
+}
+
+// unixTime converts expiresAt of a link to ExpiresAt of its record.
+func unixTime(expiresAt time.Time) int64 {
+	if expiresAt.IsZero() {
+		return 0
+	}
+	return expiresAt.Unix()
+}
+
+// batchExpiry returns the expiry of the i-th url of a batch.
+func batchExpiry(expiresAt []time.Time, i int) int64 {
+	if expiresAt == nil {
+		return 0
+	}
+	return unixTime(expiresAt[i])
+}
+
+// expired tells whether a link with ExpiresAt of its record is expired by now.
+func expired(expiresAt int64, now time.Time) bool {
+	return expiresAt != 0 && expiresAt <= now.Unix()
+}
+
+// LiveRecord tells whether the link of r works at now. Only live links hold
+// their urls, Import and the dry run of shortener-migrate check conflicts
+// against them alone.
+func LiveRecord(r middleware.JSONStruct, now time.Time) bool {
+	return !r.Deleted && !expired(r.ExpiresAt, now)
+}
+
+// liveID returns the ID url is stored under while that link works. Deleted and
+// expired links keep their codes, but their urls may be shortened anew.
+func liveID(urlID map[string]int, deleted map[int]bool, expires map[int]int64, url string) (int, bool) {
+	id, found := urlID[url]
+	if !found || deleted[id] || expired(expires[id], time.Now()) {
+		return 0, false
+	}
+	return id, true
+}
+
+// urlChange is the normal form URL of the url stored under ID.
+type urlChange struct {
+	ID  int
+	URL string
+}
+
+// normalizeBatchSize is the number of links Database and SQLite normalize in
+// one transaction.
+const normalizeBatchSize = 500
+
+// normalForms returns the changes NormalizeURLs makes to records sorted by
+// ID: of links with the same normal form the first one gets it.
+func normalForms(records []middleware.JSONStruct, normalize func(string) (string, error)) []urlChange {
+	taken := make(map[string]bool, len(records))
+	for _, r := range records {
+		if !r.Deleted {
+			taken[r.FullURL] = true
+		}
+	}
+
+	var changes []urlChange
+	for _, r := range records {
+		if r.Deleted {
+			continue
+		}
+		normal, err := normalize(r.FullURL)
+		if err != nil || normal == r.FullURL || taken[normal] {
+			continue
+		}
+		taken[normal] = true
+		changes = append(changes, urlChange{ID: r.ShortenURL, URL: normal})
+	}
+	return changes
+}
+
+// owns tells whether id is among ids of a user.
+func owns(ids []int, id int) bool {
+	for _, owned := range ids {
+		if owned == id {
+			return true
+		}
+	}
+	return false
+}
+
+// codeOf returns the short code of r, links made before codes were introduced
+// are reachable by their decimal ID.
+func codeOf(r middleware.JSONStruct) string {
+	if r.Code == "" {
+		return strconv.Itoa(r.ShortenURL)
+	}
+	return r.Code
 }
 
 //MEMORY PART//
 
 type Memory struct {
 	BaseURL  string
+	IDs      IDGenerator
 	mu       sync.Mutex
 	ID       int
 	URLID    map[string]int
 	IDURL    map[int]string
 	UserURLs map[string][]int
+	Deleted  map[int]bool
+	Codes    map[int]string
+	CodeID   map[string]int
+	Expires  map[int]int64
+	Clicks   map[int]*clickCounters
+	APIKeys  map[string]APIKey
+}
+
+func NewMemory(baseURL string) *Memory {
+	return &Memory{
+		BaseURL:  baseURL,
+		URLID:    make(map[string]int),
+		IDURL:    make(map[int]string),
+		UserURLs: make(map[string][]int),
+		Deleted:  make(map[int]bool),
+		Codes:    make(map[int]string),
+		CodeID:   make(map[string]int),
+		Expires:  make(map[int]int64),
+		Clicks:   make(map[int]*clickCounters),
+		APIKeys:  make(map[string]APIKey),
+	}
+}
+
+func (m *Memory) liveID(url string) (int, bool) {
+	return liveID(m.URLID, m.Deleted, m.Expires, url)
+}
+
+func (m *Memory) store(r middleware.JSONStruct) {
+	// a dead record imported after a live one must not take its url
+	if _, live := m.liveID(r.FullURL); !live || !r.Deleted {
+		m.URLID[r.FullURL] = r.ShortenURL
+	}
+	m.IDURL[r.ShortenURL] = r.FullURL
+	m.UserURLs[r.User] = append(m.UserURLs[r.User], r.ShortenURL)
+	m.Codes[r.ShortenURL] = r.Code
+	m.CodeID[r.Code] = r.ShortenURL
+	if r.Deleted {
+		m.Deleted[r.ShortenURL] = true
+	}
+	if r.ExpiresAt != 0 {
+		m.Expires[r.ShortenURL] = r.ExpiresAt
+	}
+	if r.ShortenURL > m.ID {
+		m.ID = r.ShortenURL
+	}
 }
 
-func (m *Memory) AddURL(url string, user string) (string, error) {
+func (m *Memory) AddURL(ctx context.Context, url string, user string, expiresAt time.Time) (string, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if _, found := m.URLID[url]; !found {
-		m.ID = m.ID + 1
-		m.URLID[url] = m.ID
-		m.IDURL[m.ID] = url
-		m.UserURLs[user] = append(m.UserURLs[user], m.ID)
+	if id, found := m.liveID(url); found {
+		return m.BaseURL + m.Codes[id], middleware.NewStorageError(middleware.ErrConflict, "409")
 	}
-	_, found := m.URLID[url]
-	if m.URLID[url] != m.ID || m.IDURL[m.ID] != url || !found {
-		return "", errors.New("error while adding new URL")
-	} else {
-		log.Println("url", url, "added to storage, you can get access by shorten:",
-			m.BaseURL+strconv.Itoa(m.URLID[url]))
-		return m.BaseURL + strconv.Itoa(m.URLID[url]), nil
+
+	id, code, err := nextCode(orDecimal(m.IDs), m.ID, func(code string) bool {
+		_, found := m.CodeID[code]
+		return found
+	})
+	if err != nil {
+		return "", err
+	}
+	m.store(middleware.JSONStruct{FullURL: url, ShortenURL: id, Code: code, User: user, ExpiresAt: unixTime(expiresAt)})
+
+	log.Println("url", url, "added to storage, you can get access by shorten:", m.BaseURL+code)
+	return m.BaseURL + code, nil
+}
+
+func (m *Memory) AddURLBatch(ctx context.Context, urls []string, user string, expiresAt []time.Time) ([]string, error) {
+	var (
+		err        error
+		newEntries []middleware.JSONStruct
+	)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	shortURLs := make([]string, len(urls))
+	added := make(map[string]string)
+	addedCodes := make(map[string]bool)
+	taken := func(code string) bool {
+		_, found := m.CodeID[code]
+		return found || addedCodes[code]
+	}
+	nextID := m.ID
+	for i, url := range urls {
+		if id, found := m.liveID(url); found {
+			shortURLs[i] = m.BaseURL + m.Codes[id]
+			err = middleware.NewStorageError(middleware.ErrConflict, "409")
+			continue
+		}
+		if code, found := added[url]; found {
+			shortURLs[i] = m.BaseURL + code
+			err = middleware.NewStorageError(middleware.ErrConflict, "409")
+			continue
+		}
+
+		id, code, genErr := nextCode(orDecimal(m.IDs), nextID, taken)
+		if genErr != nil {
+			return nil, genErr
+		}
+		nextID = id
+		added[url] = code
+		addedCodes[code] = true
+		newEntries = append(newEntries, middleware.JSONStruct{
+			FullURL: url, ShortenURL: id, Code: code, User: user, ExpiresAt: batchExpiry(expiresAt, i),
+		})
+		shortURLs[i] = m.BaseURL + code
 	}
+
+	for _, entry := range newEntries {
+		m.store(entry)
+	}
+	return shortURLs, err
+}
+
+func (m *Memory) AddURLAlias(ctx context.Context, url string, alias string, user string,
+	expiresAt time.Time) (string, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if id, found := m.CodeID[alias]; found {
+		if m.IDURL[id] == url && owns(m.UserURLs[user], id) && !m.Deleted[id] && !expired(m.Expires[id], time.Now()) {
+			return m.BaseURL + alias, nil
+		}
+		return "", middleware.NewStorageError(middleware.ErrAliasTaken, "409")
+	}
+	if id, found := m.liveID(url); found {
+		return m.BaseURL + m.Codes[id], middleware.NewStorageError(middleware.ErrConflict, "409")
+	}
+
+	m.store(middleware.JSONStruct{FullURL: url, ShortenURL: m.ID + 1, Code: alias, User: user, ExpiresAt: unixTime(expiresAt)})
+
+	log.Println("url", url, "added to storage, you can get access by shorten:", m.BaseURL+alias)
+	return m.BaseURL + alias, nil
 }
 
-func (m *Memory) SearchURL(id int) (string, error) {
+func (m *Memory) SearchURL(ctx context.Context, code string) (string, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if m.IDURL[id] != "" {
+	if id, found := m.CodeID[code]; found {
+		if m.Deleted[id] || expired(m.Expires[id], time.Now()) {
+			return m.IDURL[id], middleware.ErrGone
+		}
 		return m.IDURL[id], nil
 	} else {
-		return "", errors.New("no URL with this ID")
+		return "", middleware.ErrNotFound
 	}
 
 }
 
-func (m *Memory) GetAllURLForUser(user string) ([]middleware.JSONStructForAuth, error) {
+func (m *Memory) GetAllURLForUser(ctx context.Context, user string) ([]middleware.JSONStructForAuth, error) {
 
 	var (
 		JSONStructList []middleware.JSONStructForAuth
 		JSONStruct     middleware.JSONStructForAuth
 	)
 
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
 	if len(m.UserURLs[user]) == 0 {
 		return JSONStructList, middleware.ErrNoContent
 	} else {
 		for i := range m.UserURLs[user] {
-			JSONStruct.ShortURL = m.BaseURL + strconv.Itoa(m.UserURLs[user][i])
-			JSONStruct.OriginalURL, _ = m.SearchURL(m.UserURLs[user][i])
+			if m.Deleted[m.UserURLs[user][i]] || expired(m.Expires[m.UserURLs[user][i]], now) {
+				continue
+			}
+			JSONStruct.ShortURL = m.BaseURL + m.Codes[m.UserURLs[user][i]]
+			JSONStruct.OriginalURL = m.IDURL[m.UserURLs[user][i]]
 			JSONStructList = append(JSONStructList, JSONStruct)
 
 		}
+		if len(JSONStructList) == 0 {
+			return JSONStructList, middleware.ErrNoContent
+		}
 		return JSONStructList, nil
 	}
 }
 
-func (m *Memory) Ping() error {
-	return errors.New("there is no connection to DB")
+func (m *Memory) DeleteURLs(ctx context.Context, codes []string, user string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	owned := make(map[int]bool, len(m.UserURLs[user]))
+	for _, id := range m.UserURLs[user] {
+		owned[id] = true
+	}
+
+	for _, code := range codes {
+		if id, found := m.CodeID[code]; found && owned[id] {
+			m.Deleted[id] = true
+		}
+	}
+	return nil
 }
 
-//FILE PART//
+func (m *Memory) DisableURLs(ctx context.Context, codes []string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-type File struct {
-	BaseURL        string
-	Filepath       string
-	mu             sync.Mutex
-	ID             int
-	URLID          map[string]int
-	IDURL          map[int]string
-	UserURLs       map[string][]int
-	URLSToWrite    middleware.JSONStruct
-	JSONStructList []middleware.JSONStruct
+	var count int
+	for _, code := range codes {
+		if id, found := m.CodeID[code]; found && !m.Deleted[id] {
+			m.Deleted[id] = true
+			count++
+		}
+	}
+	return count, nil
 }
 
-func (f *File) NewFromFile(baseURL string, targets []middleware.JSONStruct) {
-	f.mu.Lock()
-	defer f.mu.Unlock()
-	f.JSONStructList = targets
+func (m *Memory) Export(ctx context.Context, fn func(middleware.JSONStruct) error) error {
+	m.mu.Lock()
+	records := make([]middleware.JSONStruct, 0, len(m.IDURL))
+	owners := make(map[int]string, len(m.IDURL))
+	for user, ids := range m.UserURLs {
+		for _, id := range ids {
+			owners[id] = user
+		}
+	}
+	for id, url := range m.IDURL {
+		records = append(records, middleware.JSONStruct{
+			FullURL: url, ShortenURL: id, Code: m.Codes[id], User: owners[id], Deleted: m.Deleted[id],
+			ExpiresAt: m.Expires[id],
+		})
+	}
+	m.mu.Unlock()
 
-	for _, t := range targets {
-		f.URLID[t.FullURL] = t.ShortenURL
-		f.IDURL[t.ShortenURL] = t.FullURL
-		f.UserURLs[t.User] = append(f.UserURLs[t.User], t.ShortenURL)
-		f.ID = t.ShortenURL
-		log.Println("url", t.FullURL, "added to storage, you can get access by shorten:", baseURL+strconv.Itoa(t.ShortenURL))
+	sort.Slice(records, func(i, k int) bool { return records[i].ShortenURL < records[k].ShortenURL })
+	for _, record := range records {
+		if err := fn(record); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func (f *File) AddURL(url string, user string) (string, error) {
+func (m *Memory) Import(ctx context.Context, records []middleware.JSONStruct) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	f.mu.Lock()
-	defer f.mu.Unlock()
+	toImport, err := filterImport(records, m.IDURL, m.liveID, m.CodeID)
+	if err != nil {
+		return err
+	}
 
-	if _, found := f.URLID[url]; !found {
+	for _, r := range toImport {
+		m.store(r)
+	}
+	return nil
+}
 
-		f.ID = f.ID + 1
-		f.URLID[url] = f.ID
-		f.IDURL[f.ID] = url
-		f.UserURLs[user] = append(f.UserURLs[user], f.ID)
+// filterImport drops records with already used IDs, fills in missing codes and
+// checks that none of the rest has its code stored under another ID or, while
+// it is live, its URL under another live one.
+func filterImport(records []middleware.JSONStruct, idURL map[int]string, liveID func(url string) (int, bool),
+	codeID map[string]int) ([]middleware.JSONStruct, error) {
 
-		f.URLSToWrite.FullURL = url
-		f.URLSToWrite.ShortenURL = f.URLID[url]
-		f.URLSToWrite.User = user
+	toImport := make([]middleware.JSONStruct, 0, len(records))
+	seenURLs := make(map[string]int, len(records))
+	seenCodes := make(map[string]int, len(records))
+	for _, r := range records {
+		if _, found := idURL[r.ShortenURL]; found {
+			continue
+		}
+		r.Code = codeOf(r)
 
-		f.JSONStructList = append(f.JSONStructList, f.URLSToWrite)
-		jsonString, err := json.Marshal(f.JSONStructList)
-		if err != nil {
-			return "", err
+		id, found := liveID(r.FullURL)
+		if !found {
+			id, found = seenURLs[r.FullURL]
+		}
+		if found && id != r.ShortenURL && !r.Deleted {
+			return nil, middleware.NewStorageError(middleware.ErrConflict,
+				fmt.Sprintf("409 url %s is already stored with ID %d", r.FullURL, id))
 		}
-		os.WriteFile(f.Filepath, jsonString, 0644)
-	}
 
-	_, found := f.URLID[url]
-	if f.URLID[url] != f.ID || f.IDURL[f.ID] != url || !found {
-		return "", errors.New("error while adding new URL")
-	} else {
-		log.Println("url", url, "added to storage, you can get access by shorten:",
-			f.BaseURL+strconv.Itoa(f.URLID[url]))
-		return f.BaseURL + strconv.Itoa(f.URLID[url]), nil
+		id, found = codeID[r.Code]
+		if !found {
+			id, found = seenCodes[r.Code]
+		}
+		if found && id != r.ShortenURL {
+			return nil, middleware.NewStorageError(middleware.ErrConflict,
+				fmt.Sprintf("409 code %s is already used by ID %d", r.Code, id))
+		}
+
+		if !r.Deleted {
+			seenURLs[r.FullURL] = r.ShortenURL
+		}
+		seenCodes[r.Code] = r.ShortenURL
+		toImport = append(toImport, r)
 	}
+	return toImport, nil
 }
 
-func (f *File) SearchURL(id int) (string, error) {
-	f.mu.Lock()
-	defer f.mu.Unlock()
-	return f.IDURL[id], nil
+func (m *Memory) ExpireURLs(ctx context.Context, now time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var count int
+	for id, expiresAt := range m.Expires {
+		if expired(expiresAt, now) && !m.Deleted[id] {
+			m.Deleted[id] = true
+			count++
+		}
+	}
+	return count, nil
 }
 
-func (f *File) GetAllURLForUser(user string) ([]middleware.JSONStructForAuth, error) {
-	var (
-		JSONStructList []middleware.JSONStructForAuth
-		JSONStruct     middleware.JSONStructForAuth
-	)
+func (m *Memory) NormalizeURLs(ctx context.Context, normalize func(string) (string, error)) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	log.Println(user)
-	log.Println(f.UserURLs)
-	if len(f.UserURLs[user]) == 0 {
-		return JSONStructList, middleware.ErrNoContent
-	} else {
-		for i := range f.UserURLs[user] {
-			JSONStruct.ShortURL = f.BaseURL + strconv.Itoa(f.UserURLs[user][i])
-			JSONStruct.OriginalURL, _ = f.SearchURL(f.UserURLs[user][i])
-			JSONStructList = append(JSONStructList, JSONStruct)
+	records := make([]middleware.JSONStruct, 0, len(m.IDURL))
+	for id, url := range m.IDURL {
+		records = append(records, middleware.JSONStruct{FullURL: url, ShortenURL: id, Deleted: m.Deleted[id]})
+	}
+	sort.Slice(records, func(i, k int) bool { return records[i].ShortenURL < records[k].ShortenURL })
 
+	changes := normalForms(records, normalize)
+	for _, c := range changes {
+		if old := m.IDURL[c.ID]; m.URLID[old] == c.ID {
+			delete(m.URLID, old)
 		}
-		return JSONStructList, nil
+		m.IDURL[c.ID] = c.URL
+		m.URLID[c.URL] = c.ID
 	}
+	return len(changes), nil
 }
 
-func (f *File) Ping() error {
-	return errors.New("there is no connection to DB")
+func (m *Memory) AddClicks(ctx context.Context, clicks []Click) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	countClicks(clicks, m.CodeID, m.Clicks)
+	return nil
 }
 
-//DATABASE PART//
+func (m *Memory) ExportClicks(ctx context.Context, fn func(ClickCounter) error) error {
+	m.mu.Lock()
+	counters := hourlyCounters(m.Codes, m.Clicks)
+	m.mu.Unlock()
 
-type Database struct {
-	BaseURL        string
-	DBConnURL      string
-	CTX            context.Context
-	ConnPool       *pgxpool.Pool
-	DBErrorConnect error
+	for _, c := range counters {
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (db *Database) GetRows(query string) (pgx.Rows, error) {
-	ctx, cancel := context.WithTimeout(db.CTX, 5*time.Second)
-	defer cancel()
+func (m *Memory) ImportClicks(ctx context.Context, counters []ClickCounter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	rows, err := db.ConnPool.Query(ctx, query)
-	if err != nil {
-		return nil, err
-	}
-	return rows, nil
+	addCounters(filterCounters(counters, m.CodeID, m.Clicks), m.CodeID, m.Clicks)
+	return nil
 }
 
-func (db *Database) Exec(query string) (pgconn.CommandTag, error) {
-	res, err := db.ConnPool.Exec(db.CTX, query)
-	if err != nil {
-		return nil, err
+func (m *Memory) LinkStats(ctx context.Context, code string, user string) (LinkStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id, found := m.CodeID[code]
+	if !found {
+		return LinkStats{}, middleware.ErrNotFound
 	}
-	return res, nil
+	if !owns(m.UserURLs[user], id) {
+		return LinkStats{}, middleware.ErrForbidden
+	}
+	return m.Clicks[id].stats(code), nil
 }
 
-func (db *Database) GetDBConnection() (*pgxpool.Pool, error) {
-	pool, err := pgxpool.Connect(db.CTX, db.DBConnURL)
-	if err != nil {
-		return nil, err
-	} else {
-		return pool, nil
+// knownClicks returns the clicks of codes in codeID, the rest are skipped.
+func knownClicks(clicks []Click, codeID map[string]int) []Click {
+	known := make([]Click, 0, len(clicks))
+	for _, c := range clicks {
+		if _, found := codeID[c.Code]; found {
+			known = append(known, c)
+		}
 	}
+	return known
 }
 
-func (db *Database) Ping() error {
-	if db.DBErrorConnect != nil {
-		return db.DBErrorConnect
-	} else {
-		err := db.ConnPool.Ping(db.CTX)
-		return err
+// countClicks adds clicks to counters of the links they were made by.
+func countClicks(clicks []Click, codeID map[string]int, counters map[int]*clickCounters) {
+	for key, n := range aggregateClicks(clicks) {
+		id, found := codeID[key.Code]
+		if !found {
+			continue
+		}
+		if counters[id] == nil {
+			counters[id] = &clickCounters{}
+		}
+		counters[id].add(key, n)
 	}
 }
 
-func (db *Database) AddURL(url string, user string) (string, error) {
-	var newID int64
+func (m *Memory) GetStats(ctx context.Context) (middleware.JSONStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	row := db.ConnPool.QueryRow(db.CTX, "INSERT INTO public.storage (full_url, user_id) VALUES ($1, $2) RETURNING id",
-		url, user)
-	if err := row.Scan(&newID); err != nil {
-		return "", fmt.Errorf("318: row.Scan: %w", err)
-	} else {
-		return db.BaseURL + strconv.FormatInt(newID, 10), nil
+	return middleware.JSONStats{URLs: len(m.IDURL), Users: countUsers(m.UserURLs)}, nil
+}
+
+// countUsers counts users with links, links made without a user are not
+// counted as one.
+func countUsers(userURLs map[string][]int) int {
+	var count int
+	for user, ids := range userURLs {
+		if user != "" && len(ids) > 0 {
+			count++
+		}
 	}
+	return count
 }
 
-func (db *Database) SearchURL(id int) (string, error) {
-	var url string
-	query := fmt.Sprintf("select full_url from %s.%s where id = %v", schema, table, id)
-	row, err := db.GetRows(query)
-	if err != nil {
-		return "", err
+func (m *Memory) AddAPIKey(ctx context.Context, key APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.APIKeys[key.Hash] = key
+	return nil
+}
+
+func (m *Memory) GetAPIKeys(ctx context.Context, user string) ([]APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return userAPIKeys(m.APIKeys, user), nil
+}
+
+func (m *Memory) DeleteAPIKeys(ctx context.Context, ids []string, user string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deleteAPIKeys(m.APIKeys, ids, user)
+	return nil
+}
+
+func (m *Memory) UserByAPIKey(ctx context.Context, hash string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if key, found := m.APIKeys[hash]; found {
+		return key.User, nil
 	}
-	defer row.Close()
+	return "", middleware.ErrNotFound
+}
 
-	for row.Next() {
-		value, err := row.Values()
-		if err != nil {
-			return "", err
-		}
+func (m *Memory) ExportAPIKeys(ctx context.Context, fn func(APIKey) error) error {
+	m.mu.Lock()
+	keys := sortedAPIKeys(m.APIKeys)
+	m.mu.Unlock()
 
-		if value[0] == nil {
-			url = ""
-		} else {
-			url = value[0].(string)
+	for _, key := range keys {
+		if err := fn(key); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	return url, nil
+func (m *Memory) ImportAPIKeys(ctx context.Context, keys []APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
+	importAPIKeys(m.APIKeys, keys)
+	return nil
 }
 
-func (db *Database) GetAllURLForUser(user string) ([]middleware.JSONStructForAuth, error) {
-	var (
-		JSONStructList []middleware.JSONStructForAuth
-		JSONStruct     middleware.JSONStructForAuth
-		returnErr      error
-	)
+func (m *Memory) Ping(ctx context.Context) error {
+	return errors.New("there is no connection to DB")
+}
+
+// Close has nothing to write, memory is gone with the process.
+func (m *Memory) Close() error {
+	return nil
+}
+
+//FILE PART//
+
+type FileConfig struct {
+	Sync            SyncPolicy
+	SyncInterval    time.Duration
+	CompactInterval time.Duration
+}
+
+type File struct {
+	BaseURL        string
+	Filepath       string
+	IDs            IDGenerator
+	mu             sync.Mutex
+	ID             int
+	URLID          map[string]int
+	IDURL          map[int]string
+	UserURLs       map[string][]int
+	Deleted        map[int]bool
+	Codes          map[int]string
+	CodeID         map[string]int
+	Expires        map[int]int64
+	Clicks         map[int]*clickCounters
+	APIKeys        map[string]APIKey
+	JSONStructList []middleware.JSONStruct
 
-	query := fmt.Sprintf("select id, full_url from %s.%s where user_id = '%s'", schema, table, user)
+	journal   *Journal
+	clicks    *clickLog
+	keysPath  string
+	stop      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
 
-	row, err := db.GetRows(query)
+// NewFile loads the journal at filePath (creating it if needed) and starts the
+// background sync and compaction according to cfg. API keys are kept in a
+// separate file at filePath + ".keys", clicks at filePath + ".clicks".
+func NewFile(baseURL string, filePath string, cfg FileConfig) (*File, error) {
+	keysPath := filePath + ".keys"
+	apiKeys, err := loadAPIKeys(keysPath)
 	if err != nil {
 		return nil, err
 	}
-	defer row.Close()
-
-	if !row.Next() {
-		returnErr = middleware.ErrNoContent
-	} else {
-		value, err := row.Values()
-		if err != nil {
-			return nil, err
-		}
 
-		JSONStruct.ShortURL = db.BaseURL + strconv.FormatInt(int64(value[0].(int32)), 10)
-		JSONStruct.OriginalURL = value[1].(string)
-		JSONStructList = append(JSONStructList, JSONStruct)
-	}
+	journal, targets, err := OpenJournal(filePath, cfg.Sync)
+	if err != nil {
+		return nil, err
+	}
+	clicks, clickLines, err := openClickLog(filePath+".clicks", cfg.Sync)
+	if err != nil {
+		journal.Close()
+		return nil, err
+	}
+
+	f := &File{
+		BaseURL:  baseURL,
+		Filepath: filePath,
+		URLID:    make(map[string]int),
+		IDURL:    make(map[int]string),
+		UserURLs: make(map[string][]int),
+		Deleted:  make(map[int]bool),
+		Codes:    make(map[int]string),
+		CodeID:   make(map[string]int),
+		Expires:  make(map[int]int64),
+		Clicks:   make(map[int]*clickCounters),
+		APIKeys:  apiKeys,
+		journal:  journal,
+		clicks:   clicks,
+		keysPath: keysPath,
+		stop:     make(chan struct{}),
+	}
+	f.load(targets)
+	countClickLines(clickLines, f.CodeID, f.Clicks)
+
+	if cfg.Sync == SyncInterval && cfg.SyncInterval > 0 {
+		f.wg.Add(1)
+		go f.every(cfg.SyncInterval, f.syncJournal)
+	}
+	if cfg.CompactInterval > 0 {
+		f.wg.Add(1)
+		go f.every(cfg.CompactInterval, f.compact)
+	}
+	return f, nil
+}
+
+func (f *File) load(targets []middleware.JSONStruct) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.JSONStructList = targets
+
+	for i := range targets {
+		targets[i].Code = codeOf(targets[i])
+		f.index(targets[i])
+		log.Println("url", targets[i].FullURL, "added to storage, you can get access by shorten:", f.BaseURL+targets[i].Code)
+	}
+}
+
+// index puts r into the lookup maps, the journal is written separately.
+func (f *File) index(r middleware.JSONStruct) {
+	// a dead record imported after a live one must not take its url
+	if _, live := f.liveID(r.FullURL); !live || !r.Deleted {
+		f.URLID[r.FullURL] = r.ShortenURL
+	}
+	f.IDURL[r.ShortenURL] = r.FullURL
+	f.UserURLs[r.User] = append(f.UserURLs[r.User], r.ShortenURL)
+	f.Codes[r.ShortenURL] = r.Code
+	f.CodeID[r.Code] = r.ShortenURL
+	if r.Deleted {
+		f.Deleted[r.ShortenURL] = true
+	}
+	if r.ExpiresAt != 0 {
+		f.Expires[r.ShortenURL] = r.ExpiresAt
+	}
+	if r.ShortenURL > f.ID {
+		f.ID = r.ShortenURL
+	}
+}
+
+func (f *File) liveID(url string) (int, bool) {
+	return liveID(f.URLID, f.Deleted, f.Expires, url)
+}
+
+func (f *File) every(interval time.Duration, job func()) {
+	defer f.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			job()
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+func (f *File) syncJournal() {
+	if err := f.journal.Sync(); err != nil {
+		log.Println("unable to sync file", f.Filepath, err)
+	}
+	if err := f.clicks.Sync(); err != nil {
+		log.Println("unable to sync clicks of file", f.Filepath, err)
+	}
+}
+
+// compact rewrites the journal once at least half of its lines are replaced
+// by later ones, and the clicks once at least half of their lines would be
+// saved by folding raw clicks into hourly buckets.
+func (f *File) compact() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	lines := f.journal.Lines()
+	if garbage := lines - len(f.JSONStructList); garbage > 0 && garbage*2 >= lines {
+		if err := f.journal.Compact(f.JSONStructList); err != nil {
+			log.Println("unable to compact file", f.Filepath, err)
+		}
+	}
+
+	counters := hourlyCounters(f.Codes, f.Clicks)
+	lines = f.clicks.Lines()
+	if garbage := lines - len(counters); garbage > 0 && garbage*2 >= lines {
+		if err := f.clicks.Compact(counters); err != nil {
+			log.Println("unable to compact clicks of file", f.Filepath, err)
+		}
+	}
+}
+
+// Close stops the background jobs and syncs the journal and clicks to disk.
+func (f *File) Close() error {
+	f.closeOnce.Do(func() { close(f.stop) })
+	f.wg.Wait()
+	err := f.journal.Close()
+	if clicksErr := f.clicks.Close(); err == nil {
+		err = clicksErr
+	}
+	return err
+}
+
+func (f *File) AddURL(ctx context.Context, url string, user string, expiresAt time.Time) (string, error) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if id, found := f.liveID(url); found {
+		return f.BaseURL + f.Codes[id], middleware.NewStorageError(middleware.ErrConflict, "409")
+	}
+
+	id, code, err := nextCode(orDecimal(f.IDs), f.ID, func(code string) bool {
+		_, found := f.CodeID[code]
+		return found
+	})
+	if err != nil {
+		return "", err
+	}
+
+	entry := middleware.JSONStruct{FullURL: url, ShortenURL: id, Code: code, User: user, ExpiresAt: unixTime(expiresAt)}
+	if err := f.journal.Append(entry); err != nil {
+		return "", err
+	}
+
+	f.JSONStructList = append(f.JSONStructList, entry)
+	f.index(entry)
+
+	log.Println("url", url, "added to storage, you can get access by shorten:", f.BaseURL+code)
+	return f.BaseURL + code, nil
+}
+
+func (f *File) AddURLBatch(ctx context.Context, urls []string, user string, expiresAt []time.Time) ([]string, error) {
+	var (
+		err        error
+		newEntries []middleware.JSONStruct
+	)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	shortURLs := make([]string, len(urls))
+	added := make(map[string]string)
+	addedCodes := make(map[string]bool)
+	taken := func(code string) bool {
+		_, found := f.CodeID[code]
+		return found || addedCodes[code]
+	}
+	nextID := f.ID
+	for i, url := range urls {
+		if id, found := f.liveID(url); found {
+			shortURLs[i] = f.BaseURL + f.Codes[id]
+			err = middleware.NewStorageError(middleware.ErrConflict, "409")
+			continue
+		}
+		if code, found := added[url]; found {
+			shortURLs[i] = f.BaseURL + code
+			err = middleware.NewStorageError(middleware.ErrConflict, "409")
+			continue
+		}
+
+		id, code, genErr := nextCode(orDecimal(f.IDs), nextID, taken)
+		if genErr != nil {
+			return nil, genErr
+		}
+		nextID = id
+		added[url] = code
+		addedCodes[code] = true
+		newEntries = append(newEntries, middleware.JSONStruct{
+			FullURL: url, ShortenURL: id, Code: code, User: user, ExpiresAt: batchExpiry(expiresAt, i),
+		})
+		shortURLs[i] = f.BaseURL + code
+	}
+
+	if len(newEntries) == 0 {
+		return shortURLs, err
+	}
+
+	if writeErr := f.journal.Append(newEntries...); writeErr != nil {
+		return nil, writeErr
+	}
+
+	f.JSONStructList = append(f.JSONStructList, newEntries...)
+	for _, entry := range newEntries {
+		f.index(entry)
+	}
+	return shortURLs, err
+}
+
+func (f *File) AddURLAlias(ctx context.Context, url string, alias string, user string,
+	expiresAt time.Time) (string, error) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if id, found := f.CodeID[alias]; found {
+		if f.IDURL[id] == url && owns(f.UserURLs[user], id) && !f.Deleted[id] && !expired(f.Expires[id], time.Now()) {
+			return f.BaseURL + alias, nil
+		}
+		return "", middleware.NewStorageError(middleware.ErrAliasTaken, "409")
+	}
+	if id, found := f.liveID(url); found {
+		return f.BaseURL + f.Codes[id], middleware.NewStorageError(middleware.ErrConflict, "409")
+	}
+
+	entry := middleware.JSONStruct{FullURL: url, ShortenURL: f.ID + 1, Code: alias, User: user, ExpiresAt: unixTime(expiresAt)}
+	if err := f.journal.Append(entry); err != nil {
+		return "", err
+	}
+
+	f.JSONStructList = append(f.JSONStructList, entry)
+	f.index(entry)
+
+	log.Println("url", url, "added to storage, you can get access by shorten:", f.BaseURL+alias)
+	return f.BaseURL + alias, nil
+}
+
+func (f *File) SearchURL(ctx context.Context, code string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id, found := f.CodeID[code]
+	if !found {
+		return "", middleware.ErrNotFound
+	}
+	if f.Deleted[id] || expired(f.Expires[id], time.Now()) {
+		return f.IDURL[id], middleware.ErrGone
+	}
+	return f.IDURL[id], nil
+}
+
+func (f *File) GetAllURLForUser(ctx context.Context, user string) ([]middleware.JSONStructForAuth, error) {
+	var (
+		JSONStructList []middleware.JSONStructForAuth
+		JSONStruct     middleware.JSONStructForAuth
+	)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	if len(f.UserURLs[user]) == 0 {
+		return JSONStructList, middleware.ErrNoContent
+	} else {
+		for i := range f.UserURLs[user] {
+			if f.Deleted[f.UserURLs[user][i]] || expired(f.Expires[f.UserURLs[user][i]], now) {
+				continue
+			}
+			JSONStruct.ShortURL = f.BaseURL + f.Codes[f.UserURLs[user][i]]
+			JSONStruct.OriginalURL = f.IDURL[f.UserURLs[user][i]]
+			JSONStructList = append(JSONStructList, JSONStruct)
+
+		}
+		if len(JSONStructList) == 0 {
+			return JSONStructList, middleware.ErrNoContent
+		}
+		return JSONStructList, nil
+	}
+}
+
+func (f *File) DeleteURLs(ctx context.Context, codes []string, user string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	owned := make(map[int]bool, len(f.UserURLs[user]))
+	for _, id := range f.UserURLs[user] {
+		owned[id] = true
+	}
+
+	toDelete := make(map[int]bool, len(codes))
+	for _, code := range codes {
+		if id, found := f.CodeID[code]; found && owned[id] && !f.Deleted[id] {
+			toDelete[id] = true
+		}
+	}
+	return f.tombstone(toDelete)
+}
+
+func (f *File) DisableURLs(ctx context.Context, codes []string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	toDelete := make(map[int]bool, len(codes))
+	for _, code := range codes {
+		if id, found := f.CodeID[code]; found && !f.Deleted[id] {
+			toDelete[id] = true
+		}
+	}
+	if err := f.tombstone(toDelete); err != nil {
+		return 0, err
+	}
+	return len(toDelete), nil
+}
+
+// tombstone marks links with ids from toDelete as deleted in the journal and
+// then in memory.
+func (f *File) tombstone(toDelete map[int]bool) error {
+	if len(toDelete) == 0 {
+		return nil
+	}
+
+	var changed []middleware.JSONStruct
+	for _, entry := range f.JSONStructList {
+		if toDelete[entry.ShortenURL] {
+			entry.Deleted = true
+			changed = append(changed, entry)
+		}
+	}
+	if err := f.journal.Append(changed...); err != nil {
+		return err
+	}
+
+	for i := range f.JSONStructList {
+		if toDelete[f.JSONStructList[i].ShortenURL] {
+			f.JSONStructList[i].Deleted = true
+			f.Deleted[f.JSONStructList[i].ShortenURL] = true
+		}
+	}
+	return nil
+}
+
+func (f *File) Export(ctx context.Context, fn func(middleware.JSONStruct) error) error {
+	f.mu.Lock()
+	records := make([]middleware.JSONStruct, len(f.JSONStructList))
+	copy(records, f.JSONStructList)
+	f.mu.Unlock()
+
+	sort.Slice(records, func(i, k int) bool { return records[i].ShortenURL < records[k].ShortenURL })
+	for _, record := range records {
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *File) Import(ctx context.Context, records []middleware.JSONStruct) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	toImport, err := filterImport(records, f.IDURL, f.liveID, f.CodeID)
+	if err != nil || len(toImport) == 0 {
+		return err
+	}
+	if err := f.journal.Append(toImport...); err != nil {
+		return err
+	}
+
+	f.JSONStructList = append(f.JSONStructList, toImport...)
+	for _, r := range toImport {
+		f.index(r)
+	}
+	return nil
+}
+
+func (f *File) ExpireURLs(ctx context.Context, now time.Time) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	toDelete := make(map[int]bool)
+	for id, expiresAt := range f.Expires {
+		if expired(expiresAt, now) && !f.Deleted[id] {
+			toDelete[id] = true
+		}
+	}
+	if err := f.tombstone(toDelete); err != nil {
+		return 0, err
+	}
+	return len(toDelete), nil
+}
+
+// NormalizeURLs appends the replaced records to the journal, so the normal
+// forms are loaded after a restart.
+func (f *File) NormalizeURLs(ctx context.Context, normalize func(string) (string, error)) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	records := make([]middleware.JSONStruct, len(f.JSONStructList))
+	copy(records, f.JSONStructList)
+	sort.Slice(records, func(i, k int) bool { return records[i].ShortenURL < records[k].ShortenURL })
+
+	changes := normalForms(records, normalize)
+	if len(changes) == 0 {
+		return 0, nil
+	}
+	normal := make(map[int]string, len(changes))
+	for _, c := range changes {
+		normal[c.ID] = c.URL
+	}
+
+	var changed []middleware.JSONStruct
+	for _, entry := range f.JSONStructList {
+		if url, found := normal[entry.ShortenURL]; found {
+			entry.FullURL = url
+			changed = append(changed, entry)
+		}
+	}
+	if err := f.journal.Append(changed...); err != nil {
+		return 0, err
+	}
+
+	for i := range f.JSONStructList {
+		entry := &f.JSONStructList[i]
+		url, found := normal[entry.ShortenURL]
+		if !found {
+			continue
+		}
+		if f.URLID[entry.FullURL] == entry.ShortenURL {
+			delete(f.URLID, entry.FullURL)
+		}
+		entry.FullURL = url
+		f.IDURL[entry.ShortenURL] = url
+		f.URLID[url] = entry.ShortenURL
+	}
+	return len(changes), nil
+}
+
+// AddClicks appends clicks to the clicks file, the counters are kept in
+// memory and rebuilt from that file on start.
+func (f *File) AddClicks(ctx context.Context, clicks []Click) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	known := knownClicks(clicks, f.CodeID)
+	if len(known) == 0 {
+		return nil
+	}
+	if err := f.clicks.Append(known); err != nil {
+		return err
+	}
+	countClicks(known, f.CodeID, f.Clicks)
+	return nil
+}
+
+func (f *File) ExportClicks(ctx context.Context, fn func(ClickCounter) error) error {
+	f.mu.Lock()
+	counters := hourlyCounters(f.Codes, f.Clicks)
+	f.mu.Unlock()
+
+	for _, c := range counters {
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *File) ImportClicks(ctx context.Context, counters []ClickCounter) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	toImport := filterCounters(counters, f.CodeID, f.Clicks)
+	if len(toImport) == 0 {
+		return nil
+	}
+	if err := f.clicks.AppendCounters(toImport); err != nil {
+		return err
+	}
+	addCounters(toImport, f.CodeID, f.Clicks)
+	return nil
+}
+
+func (f *File) LinkStats(ctx context.Context, code string, user string) (LinkStats, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id, found := f.CodeID[code]
+	if !found {
+		return LinkStats{}, middleware.ErrNotFound
+	}
+	if !owns(f.UserURLs[user], id) {
+		return LinkStats{}, middleware.ErrForbidden
+	}
+	return f.Clicks[id].stats(code), nil
+}
+
+func (f *File) GetStats(ctx context.Context) (middleware.JSONStats, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return middleware.JSONStats{URLs: len(f.IDURL), Users: countUsers(f.UserURLs)}, nil
+}
+
+func (f *File) AddAPIKey(ctx context.Context, key APIKey) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.APIKeys[key.Hash] = key
+	if err := saveAPIKeys(f.keysPath, f.APIKeys); err != nil {
+		delete(f.APIKeys, key.Hash)
+		return err
+	}
+	return nil
+}
+
+func (f *File) GetAPIKeys(ctx context.Context, user string) ([]APIKey, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return userAPIKeys(f.APIKeys, user), nil
+}
+
+func (f *File) DeleteAPIKeys(ctx context.Context, ids []string, user string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !deleteAPIKeys(f.APIKeys, ids, user) {
+		return nil
+	}
+	return saveAPIKeys(f.keysPath, f.APIKeys)
+}
+
+func (f *File) UserByAPIKey(ctx context.Context, hash string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if key, found := f.APIKeys[hash]; found {
+		return key.User, nil
+	}
+	return "", middleware.ErrNotFound
+}
+
+func (f *File) ExportAPIKeys(ctx context.Context, fn func(APIKey) error) error {
+	f.mu.Lock()
+	keys := sortedAPIKeys(f.APIKeys)
+	f.mu.Unlock()
+
+	for _, key := range keys {
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *File) ImportAPIKeys(ctx context.Context, keys []APIKey) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	added := importAPIKeys(f.APIKeys, keys)
+	if len(added) == 0 {
+		return nil
+	}
+	if err := saveAPIKeys(f.keysPath, f.APIKeys); err != nil {
+		for _, key := range added {
+			delete(f.APIKeys, key.Hash)
+		}
+		return err
+	}
+	return nil
+}
+
+func (f *File) Ping(ctx context.Context) error {
+	return errors.New("there is no connection to DB")
+}
+
+//DATABASE PART//
+
+const (
+	stmtNextIDs         = "next_ids"
+	stmtInsertURL       = "insert_url"
+	stmtSelectCodeByURL = "select_code_by_url"
+	stmtSelectByCode    = "select_by_code"
+	stmtSelectAlias     = "select_alias"
+	stmtSelectURL       = "select_url"
+	stmtRetireURL       = "retire_url"
+	stmtSelectUserURLs  = "select_user_urls"
+	stmtDeleteURLs      = "delete_urls"
+	stmtDisableURLs     = "disable_urls"
+	stmtExportURLs      = "export_urls"
+	stmtImportURL       = "import_url"
+	stmtResetSequence   = "reset_sequence"
+	stmtExpireURLs      = "expire_urls"
+	stmtSelectLiveURLs  = "select_live_urls"
+	stmtNormalizeURL    = "normalize_url"
+	stmtInsertClick     = "insert_click"
+	stmtAddClicks       = "add_clicks"
+	stmtSelectClicks    = "select_clicks"
+	stmtSelectStats     = "select_stats"
+	stmtInsertAPIKey    = "insert_api_key"
+	stmtSelectAPIKeys   = "select_api_keys"
+	stmtDeleteAPIKeys   = "delete_api_keys"
+	stmtSelectKeyUser   = "select_key_user"
+	stmtExportAPIKeys   = "export_api_keys"
+	stmtImportAPIKey    = "import_api_key"
+	stmtExportClicks    = "export_clicks"
+	stmtImportClicks    = "import_clicks"
+)
+
+// statements are prepared on every new connection of the pool, so queries are
+// always sent with parameters and never built from user input.
+var statements = map[string]string{
+	stmtNextIDs: "SELECT nextval(pg_get_serial_sequence('public.storage', 'id')) FROM generate_series(1, $1)",
+	// without a conflict target a taken url and a taken code are both
+	// skipped, stmtSelectCodeByURL tells one from the other
+	stmtInsertURL: "INSERT INTO public.storage (id, code, full_url, user_id, expires_at) VALUES ($1, $2, $3, $4, $5) " +
+		"ON CONFLICT DO NOTHING RETURNING id",
+	stmtSelectCodeByURL: "SELECT code FROM public.storage WHERE full_url = $1 AND is_deleted = false",
+	stmtSelectByCode:    "SELECT full_url, COALESCE(user_id, '') FROM public.storage WHERE code = $1",
+	stmtSelectAlias: "SELECT full_url, COALESCE(user_id, ''), " +
+		"is_deleted = false AND (expires_at IS NULL OR expires_at > now()) FROM public.storage WHERE code = $1",
+	stmtSelectURL: "SELECT full_url, is_deleted, expires_at FROM public.storage WHERE code = $1",
+	// an expired link the janitor has not marked yet must not hold its url
+	stmtRetireURL: "UPDATE public.storage SET is_deleted = true WHERE full_url = $1 AND is_deleted = false " +
+		"AND expires_at <= now()",
+	stmtSelectUserURLs: "SELECT code, full_url FROM public.storage WHERE user_id = $1 AND is_deleted = false " +
+		"AND (expires_at IS NULL OR expires_at > now()) ORDER BY id",
+	stmtDeleteURLs:  "UPDATE public.storage SET is_deleted = true WHERE code = ANY($1) AND user_id = $2",
+	stmtDisableURLs: "UPDATE public.storage SET is_deleted = true WHERE code = ANY($1) AND is_deleted = false",
+	stmtExportURLs: "SELECT id, code, full_url, COALESCE(user_id, ''), is_deleted, " +
+		"COALESCE(EXTRACT(EPOCH FROM expires_at)::bigint, 0) FROM public.storage ORDER BY id",
+	stmtImportURL: "INSERT INTO public.storage (id, code, full_url, user_id, is_deleted, expires_at) " +
+		"VALUES ($1, $2, $3, $4, $5, to_timestamp(NULLIF($6::bigint, 0))) ON CONFLICT (id) DO NOTHING",
+	stmtResetSequence: "SELECT setval(pg_get_serial_sequence('public.storage', 'id'), " +
+		"GREATEST((SELECT MAX(id) FROM public.storage), 1))",
+	stmtExpireURLs:     "UPDATE public.storage SET is_deleted = true WHERE is_deleted = false AND expires_at <= $1",
+	stmtSelectLiveURLs: "SELECT id, full_url FROM public.storage WHERE id > $1 AND is_deleted = false ORDER BY id LIMIT $2",
+	// of links with the same normal form the first one by ID gets it, a link
+	// holding it already keeps it
+	stmtNormalizeURL: "UPDATE public.storage SET full_url = $2 WHERE id = $1 " +
+		"AND NOT EXISTS (SELECT 1 FROM public.storage WHERE full_url = $2 AND is_deleted = false)",
+	// clicks are selected from storage, so clicks of unknown codes are skipped
+	stmtInsertClick: "INSERT INTO public.clicks (code, clicked_at, referrer, user_agent, ip_hash) " +
+		"SELECT code, $2, $3, $4, $5 FROM public.storage WHERE code = $1",
+	stmtAddClicks: "INSERT INTO public.click_buckets (code, period, started_at, clicks) " +
+		"SELECT code, $2, $3, $4 FROM public.storage WHERE code = $1 " +
+		"ON CONFLICT (code, period, started_at) DO UPDATE SET clicks = click_buckets.clicks + EXCLUDED.clicks",
+	stmtSelectClicks: "SELECT period, started_at, clicks FROM public.click_buckets WHERE code = $1",
+	stmtExportClicks: "SELECT code, EXTRACT(EPOCH FROM started_at)::bigint, clicks FROM public.click_buckets " +
+		"WHERE period = 'hour' ORDER BY code, started_at",
+	// the day gets the clicks of the hour only if the hour was not there yet
+	stmtImportClicks: "WITH hour AS (INSERT INTO public.click_buckets (code, period, started_at, clicks) " +
+		"SELECT code, 'hour', $2, $4 FROM public.storage WHERE code = $1 " +
+		"ON CONFLICT (code, period, started_at) DO NOTHING RETURNING code, clicks) " +
+		"INSERT INTO public.click_buckets (code, period, started_at, clicks) SELECT code, 'day', $3, clicks FROM hour " +
+		"ON CONFLICT (code, period, started_at) DO UPDATE SET clicks = click_buckets.clicks + EXCLUDED.clicks",
+	stmtSelectStats:  "SELECT COUNT(*), COUNT(DISTINCT NULLIF(user_id, '')) FROM public.storage",
+	stmtInsertAPIKey: "INSERT INTO public.api_keys (id, user_id, name, hash, created_at) VALUES ($1, $2, $3, $4, $5)",
+	stmtSelectAPIKeys: "SELECT id, user_id, name, hash, created_at FROM public.api_keys WHERE user_id = $1 " +
+		"ORDER BY created_at, id",
+	stmtDeleteAPIKeys: "DELETE FROM public.api_keys WHERE id = ANY($1) AND user_id = $2",
+	stmtSelectKeyUser: "SELECT user_id FROM public.api_keys WHERE hash = $1",
+	stmtExportAPIKeys: "SELECT id, user_id, name, hash, created_at FROM public.api_keys ORDER BY created_at, id",
+	stmtImportAPIKey: "INSERT INTO public.api_keys (id, user_id, name, hash, created_at) VALUES ($1, $2, $3, $4, $5) " +
+		"ON CONFLICT DO NOTHING",
+}
+
+// expiresAtArg is the expires_at parameter of the i-th url of a batch, NULL
+// for links that never expire.
+func expiresAtArg(expiresAt []time.Time, i int) *time.Time {
+	if expiresAt == nil || expiresAt[i].IsZero() {
+		return nil
+	}
+	return &expiresAt[i]
+}
+
+type Database struct {
+	BaseURL        string
+	IDs            IDGenerator
+	DBConnURL      string
+	Timeout        time.Duration
+	ConnPool       *pgxpool.Pool
+	DBErrorConnect error
+}
+
+// withTimeout bounds a single DB operation by db.Timeout on top of the
+// cancellation of the request context.
+func (db *Database) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if db.Timeout > 0 {
+		return context.WithTimeout(ctx, db.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+func prepareStatements(ctx context.Context, conn *pgx.Conn) error {
+	for name, sql := range statements {
+		if _, err := conn.Prepare(ctx, name, sql); err != nil {
+			return fmt.Errorf("prepare %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// pool is ConnPool or, for a DB that was unreachable on start, the error of
+// connecting, so the service keeps answering instead of panicking.
+func (db *Database) pool() (*pgxpool.Pool, error) {
+	if db.ConnPool != nil {
+		return db.ConnPool, nil
+	}
+	if db.DBErrorConnect != nil {
+		return nil, db.DBErrorConnect
+	}
+	return nil, errors.New("database is not connected")
+}
+
+func (db *Database) GetRows(ctx context.Context, query string, args ...interface{}) (pgx.Rows, error) {
+	pool, err := db.pool()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (db *Database) Exec(ctx context.Context, query string, args ...interface{}) (pgconn.CommandTag, error) {
+	pool, err := db.pool()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	res, err := pool.Exec(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// GetDBConnection connects to the DB with all statements prepared, so the
+// schema must already be migrated.
+func (db *Database) GetDBConnection(ctx context.Context) (*pgxpool.Pool, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	config, err := pgxpool.ParseConfig(db.DBConnURL)
+	if err != nil {
+		return nil, err
+	}
+	config.AfterConnect = prepareStatements
+
+	pool, err := pgxpool.ConnectConfig(ctx, config)
+	if err != nil {
+		return nil, err
+	} else {
+		return pool, nil
+	}
+}
+
+func (db *Database) Ping(ctx context.Context) error {
+	pool, err := db.pool()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	return pool.Ping(ctx)
+}
+
+// Close closes the pool once queries in progress are done.
+func (db *Database) Close() error {
+	if db.ConnPool != nil {
+		db.ConnPool.Close()
+	}
+	return nil
+}
+
+// nextIDs takes n values of the id sequence, codes of new links are made of
+// them before the rows are inserted.
+func (db *Database) nextIDs(ctx context.Context, tx pgx.Tx, n int) ([]int, error) {
+	rows, err := tx.Query(ctx, stmtNextIDs, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]int, 0, n)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// insertURLs stores urls of user in tx and returns their codes in the same
+// order and whether some of them were stored before. Urls whose new code is
+// already taken are tried again with the next ids, like nextCode does.
+func (db *Database) insertURLs(ctx context.Context, tx pgx.Tx, g IDGenerator, urls []string,
+	user string, expiresAt []time.Time) ([]string, bool, error) {
+
+	var conflict bool
+
+	codes := make([]string, len(urls))
+	pending := make([]int, len(urls))
+	for i := range pending {
+		pending[i] = i
+	}
+
+	for attempt := 0; len(pending) > 0; attempt++ {
+		if attempt == maxCodeAttempts {
+			return nil, false, ErrNoFreeCode
+		}
+
+		ids, err := db.nextIDs(ctx, tx, len(pending))
+		if err != nil {
+			return nil, false, err
+		}
+
+		batch := &pgx.Batch{}
+		for k, i := range pending {
+			code, err := g.NewCode(ids[k])
+			if err != nil {
+				return nil, false, err
+			}
+			codes[i] = code
+			batch.Queue(stmtRetireURL, urls[i])
+			batch.Queue(stmtInsertURL, ids[k], code, urls[i], user, expiresAtArg(expiresAt, i))
+			batch.Queue(stmtSelectCodeByURL, urls[i])
+		}
+
+		br := tx.SendBatch(ctx, batch)
+		var retry []int
+		for _, i := range pending {
+			var (
+				id       int64
+				existing string
+			)
+			if _, err := br.Exec(); err != nil {
+				br.Close()
+				return nil, false, err
+			}
+			insertErr := br.QueryRow().Scan(&id)
+			if insertErr != nil && !errors.Is(insertErr, pgx.ErrNoRows) {
+				br.Close()
+				return nil, false, fmt.Errorf("row.Scan: %w", insertErr)
+			}
+			selectErr := br.QueryRow().Scan(&existing)
+
+			switch {
+			case insertErr == nil:
+			case selectErr == nil:
+				codes[i] = existing
+				conflict = true
+			case errors.Is(selectErr, pgx.ErrNoRows):
+				retry = append(retry, i)
+			default:
+				br.Close()
+				return nil, false, fmt.Errorf("row.Scan: %w", selectErr)
+			}
+		}
+		if err := br.Close(); err != nil {
+			return nil, false, err
+		}
+		pending = retry
+	}
+	return codes, conflict, nil
+}
+
+func (db *Database) AddURL(ctx context.Context, url string, user string, expiresAt time.Time) (string, error) {
+	shortURLs, err := db.addURLs(ctx, orDecimal(db.IDs), []string{url}, user, []time.Time{expiresAt})
+	if shortURLs == nil {
+		return "", err
+	}
+	return shortURLs[0], err
+}
+
+func (db *Database) AddURLBatch(ctx context.Context, urls []string, user string, expiresAt []time.Time) ([]string, error) {
+	return db.addURLs(ctx, orDecimal(db.IDs), urls, user, expiresAt)
+}
+
+func (db *Database) AddURLAlias(ctx context.Context, url string, alias string, user string,
+	expiresAt time.Time) (string, error) {
+
+	var (
+		existingURL, owner string
+		live               bool
+	)
+
+	pool, err := db.pool()
+	if err != nil {
+		return "", err
+	}
+
+	checkCtx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	err = pool.QueryRow(checkCtx, stmtSelectAlias, alias).Scan(&existingURL, &owner, &live)
+	if err == nil {
+		if existingURL == url && owner == user && live {
+			return db.BaseURL + alias, nil
+		}
+		return "", middleware.NewStorageError(middleware.ErrAliasTaken, "409")
+	} else if !errors.Is(err, pgx.ErrNoRows) {
+		return "", err
+	}
+
+	shortURLs, err := db.addURLs(ctx, fixedCode(alias), []string{url}, user, []time.Time{expiresAt})
+	if errors.Is(err, ErrNoFreeCode) {
+		// taken by a concurrent request right after the check above
+		return "", middleware.NewStorageError(middleware.ErrAliasTaken, "409")
+	} else if shortURLs == nil {
+		return "", err
+	}
+	return shortURLs[0], err
+}
+
+// addURLs stores urls with codes made by g, see AddURLBatch.
+func (db *Database) addURLs(ctx context.Context, g IDGenerator, urls []string, user string,
+	expiresAt []time.Time) ([]string, error) {
+
+	pool, err := db.pool()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	codes, conflict, err := db.insertURLs(ctx, tx, g, urls, user, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	shortURLs := make([]string, len(codes))
+	for i, code := range codes {
+		shortURLs[i] = db.BaseURL + code
+	}
+	if conflict {
+		return shortURLs, middleware.NewStorageError(middleware.ErrConflict, "409")
+	}
+	return shortURLs, nil
+}
+
+func (db *Database) SearchURL(ctx context.Context, code string) (string, error) {
+	var (
+		url       string
+		isDeleted bool
+		expiresAt *time.Time
+	)
+
+	pool, err := db.pool()
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	err = pool.QueryRow(ctx, stmtSelectURL, code).Scan(&url, &isDeleted, &expiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", middleware.ErrNotFound
+	} else if err != nil {
+		return "", err
+	}
+
+	if isDeleted || expiresAt != nil && !time.Now().Before(*expiresAt) {
+		return url, middleware.ErrGone
+	}
+	return url, nil
+}
+
+func (db *Database) GetAllURLForUser(ctx context.Context, user string) ([]middleware.JSONStructForAuth, error) {
+	var (
+		JSONStructList []middleware.JSONStructForAuth
+		JSONStruct     middleware.JSONStructForAuth
+	)
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	row, err := db.GetRows(ctx, stmtSelectUserURLs, user)
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
 
 	for row.Next() {
-		value, err := row.Values()
-		if err != nil {
+		var code string
+		if err := row.Scan(&code, &JSONStruct.OriginalURL); err != nil {
 			return nil, err
 		}
 
-		JSONStruct.ShortURL = db.BaseURL + strconv.FormatInt(int64(value[0].(int32)), 10)
-		JSONStruct.OriginalURL = value[1].(string)
+		JSONStruct.ShortURL = db.BaseURL + code
 		JSONStructList = append(JSONStructList, JSONStruct)
 	}
-	fmt.Sprintln(JSONStructList)
-	return JSONStructList, returnErr
+	if err := row.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(JSONStructList) == 0 {
+		return JSONStructList, middleware.ErrNoContent
+	}
+	return JSONStructList, nil
+}
+
+func (db *Database) GetStats(ctx context.Context) (middleware.JSONStats, error) {
+	var stats middleware.JSONStats
+
+	pool, err := db.pool()
+	if err != nil {
+		return stats, err
+	}
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	err = pool.QueryRow(ctx, stmtSelectStats).Scan(&stats.URLs, &stats.Users)
+	return stats, err
+}
+
+func (db *Database) DeleteURLs(ctx context.Context, codes []string, user string) error {
+	_, err := db.Exec(ctx, stmtDeleteURLs, codes, user)
+	return err
+}
+
+func (db *Database) DisableURLs(ctx context.Context, codes []string) (int, error) {
+	tag, err := db.Exec(ctx, stmtDisableURLs, codes)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+func (db *Database) ExpireURLs(ctx context.Context, now time.Time) (int, error) {
+	tag, err := db.Exec(ctx, stmtExpireURLs, now)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// NormalizeURLs reads the table with Export and replaces the urls in a single
+// transaction, so the unique index of urls holds the normal forms only when
+// all of them are in place.
+// NormalizeURLs goes through live links by ID in batches of
+// normalizeBatchSize, each in its own transaction, so neither the whole table
+// is read at once nor is it locked for the whole run.
+func (db *Database) NormalizeURLs(ctx context.Context, normalize func(string) (string, error)) (int, error) {
+	var count, after int
+	for {
+		changes, last, err := db.normalBatch(ctx, after, normalize)
+		if err != nil || last == 0 {
+			return count, err
+		}
+		replaced, err := db.replaceURLs(ctx, changes)
+		count += replaced
+		if err != nil {
+			return count, err
+		}
+		after = last
+	}
+}
+
+// normalBatch reads the next batch of live links after the ID after and
+// returns the changes normalize makes to them and the last ID read, 0 when
+// there are no more links.
+func (db *Database) normalBatch(ctx context.Context, after int, normalize func(string) (string, error)) (
+	[]urlChange, int, error) {
+
+	var (
+		changes []urlChange
+		last    int
+	)
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.GetRows(ctx, stmtSelectLiveURLs, after, normalizeBatchSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&last, &url); err != nil {
+			return nil, 0, err
+		}
+		if normal, err := normalize(url); err == nil && normal != url {
+			changes = append(changes, urlChange{ID: last, URL: normal})
+		}
+	}
+	return changes, last, rows.Err()
+}
+
+// replaceURLs applies changes in one transaction and returns how many urls
+// were replaced, see stmtNormalizeURL.
+func (db *Database) replaceURLs(ctx context.Context, changes []urlChange) (int, error) {
+	if len(changes) == 0 {
+		return 0, nil
+	}
+
+	batch := &pgx.Batch{}
+	for _, c := range changes {
+		batch.Queue(stmtNormalizeURL, c.ID, c.URL)
+	}
+
+	pool, err := db.pool()
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var replaced int
+	br := tx.SendBatch(ctx, batch)
+	for range changes {
+		tag, err := br.Exec()
+		if err != nil {
+			br.Close()
+			return 0, err
+		}
+		replaced += int(tag.RowsAffected())
+	}
+	if err := br.Close(); err != nil {
+		return 0, err
+	}
+
+	return replaced, tx.Commit(ctx)
+}
+
+// Export reads the whole table through one query, so it is bounded by ctx only
+// and not by db.Timeout.
+func (db *Database) Export(ctx context.Context, fn func(middleware.JSONStruct) error) error {
+	rows, err := db.GetRows(ctx, stmtExportURLs)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var record middleware.JSONStruct
+		if err := rows.Scan(&record.ShortenURL, &record.Code, &record.FullURL, &record.User, &record.Deleted,
+			&record.ExpiresAt); err != nil {
+			return err
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (db *Database) Import(ctx context.Context, records []middleware.JSONStruct) error {
+	batch := &pgx.Batch{}
+
+	pool, err := db.pool()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, r := range records {
+		batch.Queue(stmtImportURL, r.ShortenURL, codeOf(r), r.FullURL, r.User, r.Deleted, r.ExpiresAt)
+	}
+	// ids were set explicitly, so SERIAL has to continue after the biggest one
+	batch.Queue(stmtResetSequence)
+
+	br := tx.SendBatch(ctx, batch)
+	for range records {
+		if _, err := br.Exec(); err != nil {
+			br.Close()
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+				return middleware.NewStorageError(middleware.ErrConflict, "409 "+pgErr.Detail)
+			}
+			return err
+		}
+	}
+	if _, err := br.Exec(); err != nil {
+		br.Close()
+		return err
+	}
+	if err := br.Close(); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (db *Database) AddClicks(ctx context.Context, clicks []Click) error {
+	batch := &pgx.Batch{}
+	for _, c := range clicks {
+		batch.Queue(stmtInsertClick, c.Code, c.Time, c.Referrer, c.UserAgent, c.IPHash)
+	}
+	for key, n := range aggregateClicks(clicks) {
+		batch.Queue(stmtAddClicks, key.Code, key.Period, time.Unix(key.Start, 0), n)
+	}
+	return db.execBatch(ctx, batch)
+}
+
+// ExportClicks reads all counters through one query, like Export.
+func (db *Database) ExportClicks(ctx context.Context, fn func(ClickCounter) error) error {
+	rows, err := db.GetRows(ctx, stmtExportClicks)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c ClickCounter
+		if err := rows.Scan(&c.Code, &c.Start, &c.Clicks); err != nil {
+			return err
+		}
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (db *Database) ImportClicks(ctx context.Context, counters []ClickCounter) error {
+	batch := &pgx.Batch{}
+	for _, c := range counters {
+		hour, day := bucketStarts(time.Unix(c.Start, 0))
+		batch.Queue(stmtImportClicks, c.Code, time.Unix(hour, 0), time.Unix(day, 0), c.Clicks)
+	}
+	return db.execBatch(ctx, batch)
+}
+
+// execBatch sends batch in one transaction.
+func (db *Database) execBatch(ctx context.Context, batch *pgx.Batch) error {
+	pool, err := db.pool()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	br := tx.SendBatch(ctx, batch)
+	for i := 0; i < batch.Len(); i++ {
+		if _, err := br.Exec(); err != nil {
+			br.Close()
+			return err
+		}
+	}
+	if err := br.Close(); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (db *Database) LinkStats(ctx context.Context, code string, user string) (LinkStats, error) {
+	var (
+		url    string
+		owner  string
+		hourly []ClickBucket
+		daily  []ClickBucket
+	)
+
+	pool, err := db.pool()
+	if err != nil {
+		return LinkStats{}, err
+	}
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	err = pool.QueryRow(ctx, stmtSelectByCode, code).Scan(&url, &owner)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return LinkStats{}, middleware.ErrNotFound
+	} else if err != nil {
+		return LinkStats{}, err
+	}
+	if owner != user {
+		return LinkStats{}, middleware.ErrForbidden
+	}
+
+	rows, err := db.GetRows(ctx, stmtSelectClicks, code)
+	if err != nil {
+		return LinkStats{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			period string
+			bucket ClickBucket
+		)
+		if err := rows.Scan(&period, &bucket.Start, &bucket.Clicks); err != nil {
+			return LinkStats{}, err
+		}
+		bucket.Start = bucket.Start.UTC()
+		if period == periodHour {
+			hourly = append(hourly, bucket)
+		} else {
+			daily = append(daily, bucket)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return LinkStats{}, err
+	}
+	return newLinkStats(code, hourly, daily), nil
+}
+
+func (db *Database) AddAPIKey(ctx context.Context, key APIKey) error {
+	_, err := db.Exec(ctx, stmtInsertAPIKey, key.ID, key.User, key.Name, key.Hash, key.CreatedAt)
+	return err
+}
+
+func (db *Database) GetAPIKeys(ctx context.Context, user string) ([]APIKey, error) {
+	var keys []APIKey
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.GetRows(ctx, stmtSelectAPIKeys, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key APIKey
+		if err := rows.Scan(&key.ID, &key.User, &key.Name, &key.Hash, &key.CreatedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (db *Database) DeleteAPIKeys(ctx context.Context, ids []string, user string) error {
+	_, err := db.Exec(ctx, stmtDeleteAPIKeys, ids, user)
+	return err
+}
+
+func (db *Database) UserByAPIKey(ctx context.Context, hash string) (string, error) {
+	var user string
+
+	pool, err := db.pool()
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	err = pool.QueryRow(ctx, stmtSelectKeyUser, hash).Scan(&user)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", middleware.ErrNotFound
+	}
+	return user, err
+}
+
+func (db *Database) ExportAPIKeys(ctx context.Context, fn func(APIKey) error) error {
+	rows, err := db.GetRows(ctx, stmtExportAPIKeys)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key APIKey
+		if err := rows.Scan(&key.ID, &key.User, &key.Name, &key.Hash, &key.CreatedAt); err != nil {
+			return err
+		}
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (db *Database) ImportAPIKeys(ctx context.Context, keys []APIKey) error {
+	batch := &pgx.Batch{}
+	for _, key := range keys {
+		batch.Queue(stmtImportAPIKey, key.ID, key.User, key.Name, key.Hash, key.CreatedAt)
+	}
+	return db.execBatch(ctx, batch)
 }
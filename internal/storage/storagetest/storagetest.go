@@ -0,0 +1,875 @@
+// Package storagetest checks that every storage.Storage implementation behaves
+// the same way, so handlers never have to care which backend is in use.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	middleware "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/middleware"
+	storage "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/storage"
+	"github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/urlnorm"
+)
+
+// Factory opens a fresh storage for a single test. For backends that persist
+// data it also returns reopen, which releases st and opens the same data again
+// as if the service was restarted; otherwise reopen is nil.
+type Factory func(t *testing.T) (st storage.Storage, reopen func() storage.Storage)
+
+// Run runs the whole conformance suite against storages made by factory. URLs
+// and users are unique per run, so a shared database does not need cleanup.
+func Run(t *testing.T, factory Factory) {
+	t.Run("AddAndSearch", func(t *testing.T) { testAddAndSearch(t, factory) })
+	t.Run("Duplicate", func(t *testing.T) { testDuplicate(t, factory) })
+	t.Run("MissingID", func(t *testing.T) { testMissingID(t, factory) })
+	t.Run("Batch", func(t *testing.T) { testBatch(t, factory) })
+	t.Run("Alias", func(t *testing.T) { testAlias(t, factory) })
+	t.Run("Expiry", func(t *testing.T) { testExpiry(t, factory) })
+	t.Run("UserListing", func(t *testing.T) { testUserListing(t, factory) })
+	t.Run("Delete", func(t *testing.T) { testDelete(t, factory) })
+	t.Run("Reshorten", func(t *testing.T) { testReshorten(t, factory) })
+	t.Run("Normalize", func(t *testing.T) { testNormalize(t, factory) })
+	t.Run("Disable", func(t *testing.T) { testDisable(t, factory) })
+	t.Run("Clicks", func(t *testing.T) { testClicks(t, factory) })
+	t.Run("Stats", func(t *testing.T) { testStats(t, factory) })
+	t.Run("APIKeys", func(t *testing.T) { testAPIKeys(t, factory) })
+	t.Run("Concurrency", func(t *testing.T) { testConcurrency(t, factory) })
+	t.Run("Restart", func(t *testing.T) { testRestart(t, factory) })
+	t.Run("ExportImport", func(t *testing.T) { testExportImport(t, factory) })
+	t.Run("ExportImportClicks", func(t *testing.T) { testExportImportClicks(t, factory) })
+	t.Run("ExportImportAPIKeys", func(t *testing.T) { testExportImportAPIKeys(t, factory) })
+	t.Run("Close", func(t *testing.T) { testClose(t, factory) })
+}
+
+// manyValues is more than SQLite binds in one statement since 3.32 (32766),
+// requests that delete or disable by a list may carry that many.
+const manyValues = 40000
+
+// padded puts values at both ends of manyValues codes or IDs that are not
+// stored.
+func padded(first string, last string) []string {
+	values := []string{first}
+	for i := 0; i < manyValues; i++ {
+		values = append(values, fmt.Sprintf("missing%dvalue", i))
+	}
+	return append(values, last)
+}
+
+// normalizeMany is more links than storages normalize in one transaction.
+const normalizeMany = 1200
+
+func newURL(t *testing.T) string {
+	return "https://" + newUser(t) + ".example.com/" + strings.ReplaceAll(t.Name(), "/", "-")
+}
+
+func newUser(t *testing.T) string {
+	u, err := uuid.NewV4()
+	require.NoError(t, err)
+	return u.String()
+}
+
+// shortCode takes the code from a short link, which always ends with it.
+func shortCode(t *testing.T, shortURL string) string {
+	t.Helper()
+	code := shortURL[strings.LastIndex(shortURL, "/")+1:]
+	require.NotEmpty(t, code, "short link %q does not end with code", shortURL)
+	return code
+}
+
+func isConflict(err error) bool {
+	var se *middleware.StorageError
+	return errors.As(err, &se) && errors.Is(se.Err, middleware.ErrConflict)
+}
+
+func requireURL(t *testing.T, st storage.Storage, shortURL string, want string) {
+	t.Helper()
+	got, err := st.SearchURL(context.Background(), shortCode(t, shortURL))
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+}
+
+func testAddAndSearch(t *testing.T, factory Factory) {
+	st, _ := factory(t)
+	ctx := context.Background()
+
+	url := newURL(t)
+	shortURL, err := st.AddURL(ctx, url, newUser(t), time.Time{})
+	require.NoError(t, err)
+	requireURL(t, st, shortURL, url)
+
+	otherURL := newURL(t)
+	otherShortURL, err := st.AddURL(ctx, otherURL, newUser(t), time.Time{})
+	require.NoError(t, err)
+	assert.NotEqual(t, shortURL, otherShortURL)
+	requireURL(t, st, otherShortURL, otherURL)
+}
+
+func testDuplicate(t *testing.T, factory Factory) {
+	st, _ := factory(t)
+	ctx := context.Background()
+
+	url := newURL(t)
+	shortURL, err := st.AddURL(ctx, url, newUser(t), time.Time{})
+	require.NoError(t, err)
+
+	for _, user := range []string{newUser(t), newUser(t)} {
+		again, err := st.AddURL(ctx, url, user, time.Time{})
+		assert.True(t, isConflict(err), "want 409 StorageError, got %v", err)
+		assert.Equal(t, shortURL, again)
+	}
+	requireURL(t, st, shortURL, url)
+}
+
+func testMissingID(t *testing.T, factory Factory) {
+	st, _ := factory(t)
+
+	url, err := st.SearchURL(context.Background(), "missing0code")
+	assert.ErrorIs(t, err, middleware.ErrNotFound)
+	assert.Empty(t, url)
+}
+
+func testBatch(t *testing.T, factory Factory) {
+	st, _ := factory(t)
+	ctx := context.Background()
+	user := newUser(t)
+
+	existing := newURL(t)
+	existingShortURL, err := st.AddURL(ctx, existing, newUser(t), time.Time{})
+	require.NoError(t, err)
+
+	urls := []string{newURL(t), newURL(t), newURL(t)}
+	shortURLs, err := st.AddURLBatch(ctx, urls, user, nil)
+	require.NoError(t, err)
+	require.Len(t, shortURLs, len(urls))
+	for i := range urls {
+		requireURL(t, st, shortURLs[i], urls[i])
+	}
+
+	withExisting := []string{newURL(t), existing, newURL(t)}
+	shortURLs, err = st.AddURLBatch(ctx, withExisting, user, nil)
+	assert.True(t, isConflict(err), "want 409 StorageError, got %v", err)
+	require.Len(t, shortURLs, len(withExisting))
+	assert.Equal(t, existingShortURL, shortURLs[1])
+	for i := range withExisting {
+		requireURL(t, st, shortURLs[i], withExisting[i])
+	}
+}
+
+func testAlias(t *testing.T, factory Factory) {
+	st, _ := factory(t)
+	ctx := context.Background()
+	alice, bob := newUser(t), newUser(t)
+	alias := "sale-" + strings.ReplaceAll(newUser(t), "-", "")
+
+	url := newURL(t)
+	shortURL, err := st.AddURLAlias(ctx, url, alias, alice, time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, alias, shortCode(t, shortURL))
+	requireURL(t, st, shortURL, url)
+
+	again, err := st.AddURLAlias(ctx, url, alias, alice, time.Time{})
+	assert.NoError(t, err, "the same alias of the same user must be accepted again")
+	assert.Equal(t, shortURL, again)
+
+	for _, taken := range []struct {
+		url  string
+		user string
+	}{{url, bob}, {newURL(t), alice}, {newURL(t), bob}} {
+		_, err = st.AddURLAlias(ctx, taken.url, alias, taken.user, time.Time{})
+		assert.ErrorIs(t, err, middleware.ErrAliasTaken)
+	}
+	requireURL(t, st, shortURL, url)
+
+	generated := newURL(t)
+	generatedShortURL, err := st.AddURL(ctx, generated, bob, time.Time{})
+	require.NoError(t, err)
+	otherAlias := alias + "-2"
+	existing, err := st.AddURLAlias(ctx, generated, otherAlias, bob, time.Time{})
+	assert.True(t, isConflict(err), "want 409 StorageError, got %v", err)
+	assert.Equal(t, generatedShortURL, existing)
+	_, err = st.SearchURL(ctx, otherAlias)
+	assert.ErrorIs(t, err, middleware.ErrNotFound)
+
+	list, err := st.GetAllURLForUser(ctx, alice)
+	require.NoError(t, err)
+	assert.Equal(t, []middleware.JSONStructForAuth{{ShortURL: shortURL, OriginalURL: url}}, list)
+
+	require.NoError(t, st.DeleteURLs(ctx, []string{alias}, alice))
+	_, err = st.SearchURL(ctx, alias)
+	assert.ErrorIs(t, err, middleware.ErrGone)
+
+	_, err = st.AddURLAlias(ctx, url, alias, alice, time.Time{})
+	assert.ErrorIs(t, err, middleware.ErrAliasTaken, "a deleted alias must not be handed out again")
+}
+
+func testExpiry(t *testing.T, factory Factory) {
+	st, reopen := factory(t)
+	ctx := context.Background()
+	user := newUser(t)
+	now := time.Now()
+	past, future := now.Add(-time.Minute), now.Add(time.Hour)
+
+	expiredURL, live := newURL(t), newURL(t)
+	expiredShortURL, err := st.AddURL(ctx, expiredURL, user, past)
+	require.NoError(t, err)
+	liveShortURL, err := st.AddURL(ctx, live, user, future)
+	require.NoError(t, err)
+	batch := []string{newURL(t), newURL(t)}
+	batchShortURLs, err := st.AddURLBatch(ctx, batch, user, []time.Time{past, {}})
+	require.NoError(t, err)
+	aliasURL, alias := newURL(t), "expired-"+strings.ReplaceAll(user, "-", "")
+	aliasShortURL, err := st.AddURLAlias(ctx, aliasURL, alias, user, past)
+	require.NoError(t, err)
+	_, err = st.AddURLAlias(ctx, aliasURL, alias, user, past)
+	assert.ErrorIs(t, err, middleware.ErrAliasTaken, "an expired alias must not be handed out again")
+
+	for _, shortURL := range []string{expiredShortURL, batchShortURLs[0], aliasShortURL} {
+		_, err = st.SearchURL(ctx, shortCode(t, shortURL))
+		assert.ErrorIs(t, err, middleware.ErrGone, "%s is expired", shortURL)
+	}
+	requireURL(t, st, liveShortURL, live)
+	requireURL(t, st, batchShortURLs[1], batch[1])
+
+	list, err := st.GetAllURLForUser(ctx, user)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []middleware.JSONStructForAuth{
+		{ShortURL: liveShortURL, OriginalURL: live},
+		{ShortURL: batchShortURLs[1], OriginalURL: batch[1]},
+	}, list)
+
+	count, err := st.ExpireURLs(ctx, now)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, count, 3)
+	if reopen != nil {
+		st = reopen()
+	}
+
+	records := exportAll(t, st)
+	for _, shortURL := range []string{expiredShortURL, batchShortURLs[0], aliasShortURL} {
+		record := records[shortCode(t, shortURL)]
+		assert.True(t, record.Deleted, "%s must be tombstoned", shortURL)
+		assert.Equal(t, past.Unix(), record.ExpiresAt)
+	}
+	assert.Equal(t, future.Unix(), records[shortCode(t, liveShortURL)].ExpiresAt)
+	assert.False(t, records[shortCode(t, liveShortURL)].Deleted)
+	assert.Zero(t, records[shortCode(t, batchShortURLs[1])].ExpiresAt)
+
+	_, err = st.ExpireURLs(ctx, future)
+	require.NoError(t, err)
+	_, err = st.SearchURL(ctx, shortCode(t, liveShortURL))
+	assert.ErrorIs(t, err, middleware.ErrGone)
+	requireURL(t, st, batchShortURLs[1], batch[1])
+}
+
+func testUserListing(t *testing.T, factory Factory) {
+	st, _ := factory(t)
+	ctx := context.Background()
+	alice, bob := newUser(t), newUser(t)
+
+	list, err := st.GetAllURLForUser(ctx, alice)
+	assert.ErrorIs(t, err, middleware.ErrNoContent)
+	assert.Empty(t, list)
+
+	var want []middleware.JSONStructForAuth
+	for i := 0; i < 3; i++ {
+		url := newURL(t)
+		shortURL, err := st.AddURL(ctx, url, alice, time.Time{})
+		require.NoError(t, err)
+		want = append(want, middleware.JSONStructForAuth{ShortURL: shortURL, OriginalURL: url})
+	}
+	_, err = st.AddURL(ctx, newURL(t), bob, time.Time{})
+	require.NoError(t, err)
+
+	list, err = st.GetAllURLForUser(ctx, alice)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, want, list)
+
+	list, err = st.GetAllURLForUser(ctx, bob)
+	require.NoError(t, err)
+	assert.Len(t, list, 1)
+}
+
+func testClicks(t *testing.T, factory Factory) {
+	st, _ := factory(t)
+	ctx := context.Background()
+	user := newUser(t)
+
+	shortURL, err := st.AddURL(ctx, newURL(t), user, time.Time{})
+	require.NoError(t, err)
+	code := shortCode(t, shortURL)
+
+	stats, err := st.LinkStats(ctx, code, user)
+	require.NoError(t, err)
+	assert.Equal(t, storage.LinkStats{Code: code, Hourly: []storage.ClickBucket{}, Daily: []storage.ClickBucket{}}, stats)
+
+	at := time.Date(2022, 12, 11, 23, 15, 0, 0, time.UTC)
+	clicks := []storage.Click{
+		{Code: code, Time: at, Referrer: "https://ya.ru/", UserAgent: "curl/7.85.0", IPHash: "a"},
+		{Code: code, Time: at.Add(10 * time.Minute), IPHash: "b"},
+		{Code: code, Time: at.Add(time.Hour)},
+		{Code: "missing0code", Time: at},
+	}
+	require.NoError(t, st.AddClicks(ctx, clicks[:2]))
+	require.NoError(t, st.AddClicks(ctx, clicks[2:]))
+
+	stats, err = st.LinkStats(ctx, code, user)
+	require.NoError(t, err)
+	assert.Equal(t, storage.LinkStats{
+		Code:   code,
+		Clicks: 3,
+		Hourly: []storage.ClickBucket{
+			{Start: time.Date(2022, 12, 11, 23, 0, 0, 0, time.UTC), Clicks: 2},
+			{Start: time.Date(2022, 12, 12, 0, 0, 0, 0, time.UTC), Clicks: 1},
+		},
+		Daily: []storage.ClickBucket{
+			{Start: time.Date(2022, 12, 11, 0, 0, 0, 0, time.UTC), Clicks: 2},
+			{Start: time.Date(2022, 12, 12, 0, 0, 0, 0, time.UTC), Clicks: 1},
+		},
+	}, stats)
+
+	_, err = st.LinkStats(ctx, code, newUser(t))
+	assert.ErrorIs(t, err, middleware.ErrForbidden)
+	_, err = st.LinkStats(ctx, "missing0code", user)
+	assert.ErrorIs(t, err, middleware.ErrNotFound)
+}
+
+func testStats(t *testing.T, factory Factory) {
+	st, _ := factory(t)
+	ctx := context.Background()
+	alice, bob := newUser(t), newUser(t)
+
+	before, err := st.GetStats(ctx)
+	require.NoError(t, err)
+
+	_, err = st.AddURLBatch(ctx, []string{newURL(t), newURL(t)}, alice, nil)
+	require.NoError(t, err)
+	shortURL, err := st.AddURL(ctx, newURL(t), bob, time.Time{})
+	require.NoError(t, err)
+	require.NoError(t, st.DeleteURLs(ctx, []string{shortCode(t, shortURL)}, bob))
+	_, err = st.AddURL(ctx, newURL(t), "", time.Time{})
+	require.NoError(t, err)
+
+	after, err := st.GetStats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, before.URLs+4, after.URLs)
+	assert.Equal(t, before.Users+2, after.Users, "links without a user are not counted as a user")
+}
+
+func testAPIKeys(t *testing.T, factory Factory) {
+	st, reopen := factory(t)
+	ctx := context.Background()
+	alice, bob := newUser(t), newUser(t)
+	createdAt := time.Now().UTC().Truncate(time.Second)
+
+	keys := []storage.APIKey{
+		{ID: newUser(t), User: alice, Name: "ci", Hash: newUser(t), CreatedAt: createdAt},
+		{ID: newUser(t), User: alice, Hash: newUser(t), CreatedAt: createdAt.Add(time.Second)},
+		{ID: newUser(t), User: bob, Name: "deploy", Hash: newUser(t), CreatedAt: createdAt},
+	}
+	for _, key := range keys {
+		require.NoError(t, st.AddAPIKey(ctx, key))
+	}
+	if reopen != nil {
+		st = reopen()
+	}
+
+	user, err := st.UserByAPIKey(ctx, keys[1].Hash)
+	require.NoError(t, err)
+	assert.Equal(t, alice, user)
+	_, err = st.UserByAPIKey(ctx, "missing")
+	assert.ErrorIs(t, err, middleware.ErrNotFound)
+
+	list, err := st.GetAPIKeys(ctx, alice)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	for i := range list {
+		assert.Equal(t, keys[i].ID, list[i].ID)
+		assert.Equal(t, keys[i].Name, list[i].Name)
+		assert.Equal(t, keys[i].Hash, list[i].Hash)
+		assert.True(t, keys[i].CreatedAt.Equal(list[i].CreatedAt), "%v != %v", keys[i].CreatedAt, list[i].CreatedAt)
+	}
+
+	require.NoError(t, st.DeleteAPIKeys(ctx, padded(keys[0].ID, keys[2].ID), alice))
+	_, err = st.UserByAPIKey(ctx, keys[0].Hash)
+	assert.ErrorIs(t, err, middleware.ErrNotFound)
+	user, err = st.UserByAPIKey(ctx, keys[2].Hash)
+	require.NoError(t, err, "keys of other users are not deleted")
+	assert.Equal(t, bob, user)
+	if reopen != nil {
+		st = reopen()
+	}
+
+	list, err = st.GetAPIKeys(ctx, alice)
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, keys[1].ID, list[0].ID)
+}
+
+func testDelete(t *testing.T, factory Factory) {
+	st, _ := factory(t)
+	ctx := context.Background()
+	alice, bob := newUser(t), newUser(t)
+
+	url := newURL(t)
+	shortURL, err := st.AddURL(ctx, url, alice, time.Time{})
+	require.NoError(t, err)
+	kept := newURL(t)
+	keptShortURL, err := st.AddURL(ctx, kept, alice, time.Time{})
+	require.NoError(t, err)
+
+	require.NoError(t, st.DeleteURLs(ctx, []string{shortCode(t, shortURL)}, bob))
+	requireURL(t, st, shortURL, url)
+
+	require.NoError(t, st.DeleteURLs(ctx, padded(shortCode(t, shortURL), "missing0code"), alice))
+	_, err = st.SearchURL(ctx, shortCode(t, shortURL))
+	assert.ErrorIs(t, err, middleware.ErrGone)
+	requireURL(t, st, keptShortURL, kept)
+
+	list, err := st.GetAllURLForUser(ctx, alice)
+	require.NoError(t, err)
+	assert.Equal(t, []middleware.JSONStructForAuth{{ShortURL: keptShortURL, OriginalURL: kept}}, list)
+
+	require.NoError(t, st.DeleteURLs(ctx, []string{shortCode(t, keptShortURL)}, alice))
+	_, err = st.GetAllURLForUser(ctx, alice)
+	assert.ErrorIs(t, err, middleware.ErrNoContent)
+}
+
+// testReshorten checks that urls of deleted and expired links may be shortened
+// again, while their old codes stay gone.
+func testReshorten(t *testing.T, factory Factory) {
+	st, reopen := factory(t)
+	ctx := context.Background()
+	user := newUser(t)
+
+	deleted, expiredURL := newURL(t), newURL(t)
+	deletedShortURL, err := st.AddURL(ctx, deleted, user, time.Time{})
+	require.NoError(t, err)
+	require.NoError(t, st.DeleteURLs(ctx, []string{shortCode(t, deletedShortURL)}, user))
+	// not marked by ExpireURLs yet
+	expiredShortURL, err := st.AddURL(ctx, expiredURL, user, time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+
+	again, err := st.AddURL(ctx, deleted, user, time.Time{})
+	require.NoError(t, err, "url of a deleted link is free")
+	assert.NotEqual(t, deletedShortURL, again)
+	requireURL(t, st, again, deleted)
+
+	batch, err := st.AddURLBatch(ctx, []string{expiredURL}, user, nil)
+	require.NoError(t, err, "url of an expired link is free")
+	assert.NotEqual(t, expiredShortURL, batch[0])
+	requireURL(t, st, batch[0], expiredURL)
+
+	if reopen != nil {
+		st = reopen()
+	}
+	for _, shortURL := range []string{deletedShortURL, expiredShortURL} {
+		_, err = st.SearchURL(ctx, shortCode(t, shortURL))
+		assert.ErrorIs(t, err, middleware.ErrGone, "%s stays gone", shortURL)
+	}
+	shortURL, err := st.AddURL(ctx, deleted, user, time.Time{})
+	assert.True(t, isConflict(err), "want 409 for the live link, got %v", err)
+	assert.Equal(t, again, shortURL)
+}
+
+func testNormalize(t *testing.T, factory Factory) {
+	st, reopen := factory(t)
+	ctx := context.Background()
+	user := newUser(t)
+
+	// stored before urls were normalized
+	host := newUser(t) + ".example.com"
+	normal := "https://" + host + "/a"
+	loudURL := "HTTPS://" + strings.ToUpper(host) + ":443/a"
+	loud, err := st.AddURL(ctx, loudURL, user, time.Time{})
+	require.NoError(t, err)
+	twinURL := "https://" + strings.ToUpper(host) + "/a"
+	twin, err := st.AddURL(ctx, twinURL, user, time.Time{})
+	require.NoError(t, err)
+	deadURL := "HTTPS://" + host + "/dead"
+	dead, err := st.AddURL(ctx, deadURL, user, time.Time{})
+	require.NoError(t, err)
+	require.NoError(t, st.DeleteURLs(ctx, []string{shortCode(t, dead)}, user))
+	// more links than Database and SQLite normalize in one batch
+	many := make([]string, normalizeMany)
+	for i := range many {
+		many[i] = "HTTPS://" + strings.ToUpper(host) + "/many/" + strconv.Itoa(i)
+	}
+	manyShortURLs, err := st.AddURLBatch(ctx, many, user, nil)
+	require.NoError(t, err)
+
+	count, err := st.NormalizeURLs(ctx, urlnorm.Normalizer{}.Normalize)
+	require.NoError(t, err)
+	// a shared database may hold urls of other runs
+	assert.GreaterOrEqual(t, count, 1+normalizeMany)
+	requireURL(t, st, loud, normal)
+	requireURL(t, st, manyShortURLs[normalizeMany-1], "https://"+host+"/many/"+strconv.Itoa(normalizeMany-1))
+	requireURL(t, st, twin, twinURL)
+	assert.Equal(t, deadURL, exportAll(t, st)[shortCode(t, dead)].FullURL, "deleted links are left alone")
+
+	if reopen != nil {
+		st = reopen()
+	}
+	again, err := st.AddURL(ctx, normal, newUser(t), time.Time{})
+	assert.True(t, isConflict(err), "want 409 for the normal form, got %v", err)
+	assert.Equal(t, loud, again)
+	_, err = st.AddURL(ctx, loudURL, user, time.Time{})
+	assert.NoError(t, err, "the old form is not stored anymore")
+}
+
+func testDisable(t *testing.T, factory Factory) {
+	st, reopen := factory(t)
+	ctx := context.Background()
+	alice, bob := newUser(t), newUser(t)
+
+	url := newURL(t)
+	shortURL, err := st.AddURL(ctx, url, alice, time.Time{})
+	require.NoError(t, err)
+	other := newURL(t)
+	otherShortURL, err := st.AddURL(ctx, other, bob, time.Time{})
+	require.NoError(t, err)
+	kept := newURL(t)
+	keptShortURL, err := st.AddURL(ctx, kept, bob, time.Time{})
+	require.NoError(t, err)
+
+	// a rescan disables any number of links at once
+	codes := padded(shortCode(t, shortURL), shortCode(t, otherShortURL))
+	count, err := st.DisableURLs(ctx, codes)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// disabled links are not counted twice
+	count, err = st.DisableURLs(ctx, codes)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+	count, err = st.DisableURLs(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	if reopen != nil {
+		st = reopen()
+	}
+	for _, disabled := range []string{shortURL, otherShortURL} {
+		_, err = st.SearchURL(ctx, shortCode(t, disabled))
+		assert.ErrorIs(t, err, middleware.ErrGone)
+	}
+	requireURL(t, st, keptShortURL, kept)
+}
+
+func testConcurrency(t *testing.T, factory Factory) {
+	const workers = 8
+
+	st, _ := factory(t)
+	ctx := context.Background()
+	shared := newURL(t)
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		shortURLs = make(map[string]string)
+		shared201 int
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user := newUser(t)
+
+			url := fmt.Sprintf("%s/%d", newURL(t), i)
+			shortURL, err := st.AddURL(ctx, url, user, time.Time{})
+			assert.NoError(t, err)
+
+			sharedShortURL, sharedErr := st.AddURL(ctx, shared, user, time.Time{})
+			assert.True(t, sharedErr == nil || isConflict(sharedErr), "unexpected error %v", sharedErr)
+
+			_, err = st.GetAllURLForUser(ctx, user)
+			assert.NoError(t, err)
+			assert.NoError(t, st.DeleteURLs(ctx, []string{shortCode(t, shortURL)}, user))
+
+			mu.Lock()
+			defer mu.Unlock()
+			shortURLs[shortURL] = url
+			shortURLs[sharedShortURL] = shared
+			if sharedErr == nil {
+				shared201++
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, shared201, "shared URL must be created exactly once")
+	assert.Len(t, shortURLs, workers+1, "every URL must get its own short link")
+	for shortURL, url := range shortURLs {
+		got, err := st.SearchURL(ctx, shortCode(t, shortURL))
+		if url == shared {
+			assert.NoError(t, err)
+		} else {
+			assert.ErrorIs(t, err, middleware.ErrGone)
+		}
+		assert.Equal(t, url, got)
+	}
+}
+
+func testRestart(t *testing.T, factory Factory) {
+	st, reopen := factory(t)
+	if reopen == nil {
+		t.Skip("storage does not persist data")
+	}
+	ctx := context.Background()
+	user := newUser(t)
+
+	url := newURL(t)
+	shortURL, err := st.AddURL(ctx, url, user, time.Time{})
+	require.NoError(t, err)
+	batch := []string{newURL(t), newURL(t)}
+	batchShortURLs, err := st.AddURLBatch(ctx, batch, user, nil)
+	require.NoError(t, err)
+	require.NoError(t, st.DeleteURLs(ctx, []string{shortCode(t, batchShortURLs[0])}, user))
+
+	st = reopen()
+
+	requireURL(t, st, shortURL, url)
+	requireURL(t, st, batchShortURLs[1], batch[1])
+	_, err = st.SearchURL(ctx, shortCode(t, batchShortURLs[0]))
+	assert.ErrorIs(t, err, middleware.ErrGone)
+
+	again, err := st.AddURL(ctx, url, newUser(t), time.Time{})
+	assert.True(t, isConflict(err), "want 409 StorageError, got %v", err)
+	assert.Equal(t, shortURL, again)
+
+	newShortURL, err := st.AddURL(ctx, newURL(t), user, time.Time{})
+	require.NoError(t, err)
+	for _, old := range append(batchShortURLs, shortURL) {
+		assert.NotEqual(t, old, newShortURL, "IDs must not be reused after restart")
+	}
+
+	list, err := st.GetAllURLForUser(ctx, user)
+	require.NoError(t, err)
+	assert.Len(t, list, 3)
+}
+
+// exportAll returns all records of st by their codes.
+func exportAll(t *testing.T, st storage.Storage) map[string]middleware.JSONStruct {
+	t.Helper()
+	records := make(map[string]middleware.JSONStruct)
+	lastID := 0
+	require.NoError(t, st.Export(context.Background(), func(r middleware.JSONStruct) error {
+		assert.Greater(t, r.ShortenURL, lastID, "records must be exported in the order of IDs")
+		lastID = r.ShortenURL
+		records[r.Code] = r
+		return nil
+	}))
+	return records
+}
+
+func testExportImport(t *testing.T, factory Factory) {
+	ctx := context.Background()
+	src, _ := factory(t)
+	user := newUser(t)
+
+	shortURLs, err := src.AddURLBatch(ctx, []string{newURL(t), newURL(t), newURL(t)}, user, nil)
+	require.NoError(t, err)
+	require.NoError(t, src.DeleteURLs(ctx, []string{shortCode(t, shortURLs[1])}, user))
+
+	exported := exportAll(t, src)
+	var records []middleware.JSONStruct
+	for _, shortURL := range shortURLs {
+		record, found := exported[shortCode(t, shortURL)]
+		require.True(t, found, "%s was not exported", shortURL)
+		assert.Equal(t, user, record.User)
+		records = append(records, record)
+	}
+	assert.True(t, records[1].Deleted)
+
+	// IDs far from the ones given by the destination itself, new URLs and
+	// codes, as a database backend gives the same data to src and dst. Records
+	// without a code are links made before codes and keep their decimal IDs.
+	for i := range records {
+		records[i].ShortenURL += 1000000
+		records[i].FullURL = newURL(t)
+		records[i].Code = ""
+	}
+	records[2].Code = strings.ReplaceAll(newUser(t), "-", "")
+
+	dst, _ := factory(t)
+	require.NoError(t, dst.Import(ctx, records))
+	require.NoError(t, dst.Import(ctx, records), "import of the same records must be idempotent")
+
+	imported := exportAll(t, dst)
+	for _, record := range records {
+		if record.Code == "" {
+			record.Code = strconv.Itoa(record.ShortenURL)
+		}
+		assert.Equal(t, record, imported[record.Code])
+	}
+	_, err = dst.SearchURL(ctx, strconv.Itoa(records[1].ShortenURL))
+	assert.ErrorIs(t, err, middleware.ErrGone)
+	requireURL(t, dst, strconv.Itoa(records[0].ShortenURL), records[0].FullURL)
+	requireURL(t, dst, records[2].Code, records[2].FullURL)
+
+	list, err := dst.GetAllURLForUser(ctx, user)
+	require.NoError(t, err)
+	assert.Len(t, list, 2)
+
+	newShortURL, err := dst.AddURL(ctx, newURL(t), user, time.Time{})
+	require.NoError(t, err)
+	assert.Greater(t, exportAll(t, dst)[shortCode(t, newShortURL)].ShortenURL, records[2].ShortenURL,
+		"ID sequence must move past imported IDs")
+
+	conflicting := records[0]
+	conflicting.ShortenURL += 1000000
+	err = dst.Import(ctx, []middleware.JSONStruct{{FullURL: newURL(t), ShortenURL: conflicting.ShortenURL + 1, User: user}, conflicting})
+	assert.True(t, isConflict(err), "want 409 StorageError, got %v", err)
+	_, err = dst.SearchURL(ctx, strconv.Itoa(conflicting.ShortenURL+1))
+	assert.ErrorIs(t, err, middleware.ErrNotFound, "nothing must be imported on conflict")
+
+	takenCode := middleware.JSONStruct{FullURL: newURL(t), ShortenURL: conflicting.ShortenURL + 2, Code: records[2].Code, User: user}
+	err = dst.Import(ctx, []middleware.JSONStruct{takenCode})
+	assert.True(t, isConflict(err), "want 409 StorageError for taken code, got %v", err)
+}
+
+func testExportImportClicks(t *testing.T, factory Factory) {
+	ctx := context.Background()
+	src, _ := factory(t)
+	user := newUser(t)
+
+	shortURL, err := src.AddURL(ctx, newURL(t), user, time.Time{})
+	require.NoError(t, err)
+	code := shortCode(t, shortURL)
+	at := time.Date(2022, 12, 11, 23, 15, 0, 0, time.UTC)
+	require.NoError(t, src.AddClicks(ctx, []storage.Click{
+		{Code: code, Time: at}, {Code: code, Time: at.Add(time.Minute)}, {Code: code, Time: at.Add(time.Hour)},
+	}))
+
+	var exported []storage.ClickCounter
+	require.NoError(t, src.ExportClicks(ctx, func(c storage.ClickCounter) error {
+		if c.Code == code {
+			exported = append(exported, c)
+		}
+		return nil
+	}))
+	hour := at.Truncate(time.Hour).Unix()
+	assert.Equal(t, []storage.ClickCounter{
+		{Code: code, Start: hour, Clicks: 2},
+		{Code: code, Start: hour + 3600, Clicks: 1},
+	}, exported)
+
+	// the destination link has clicks of its own in the first hour already
+	dst, reopen := factory(t)
+	dstShortURL, err := dst.AddURL(ctx, newURL(t), user, time.Time{})
+	require.NoError(t, err)
+	dstCode := shortCode(t, dstShortURL)
+	require.NoError(t, dst.AddClicks(ctx, []storage.Click{{Code: dstCode, Time: at}}))
+
+	counters := []storage.ClickCounter{{Code: "missing0code", Start: hour, Clicks: 5}}
+	for _, c := range exported {
+		c.Code = dstCode
+		counters = append(counters, c)
+	}
+	require.NoError(t, dst.ImportClicks(ctx, counters))
+	require.NoError(t, dst.ImportClicks(ctx, counters), "import of the same counters must be idempotent")
+	if reopen != nil {
+		dst = reopen()
+	}
+
+	stats, err := dst.LinkStats(ctx, dstCode, user)
+	require.NoError(t, err)
+	assert.Equal(t, storage.LinkStats{
+		Code:   dstCode,
+		Clicks: 2,
+		Hourly: []storage.ClickBucket{
+			{Start: time.Date(2022, 12, 11, 23, 0, 0, 0, time.UTC), Clicks: 1},
+			{Start: time.Date(2022, 12, 12, 0, 0, 0, 0, time.UTC), Clicks: 1},
+		},
+		Daily: []storage.ClickBucket{
+			{Start: time.Date(2022, 12, 11, 0, 0, 0, 0, time.UTC), Clicks: 1},
+			{Start: time.Date(2022, 12, 12, 0, 0, 0, 0, time.UTC), Clicks: 1},
+		},
+	}, stats)
+}
+
+func testExportImportAPIKeys(t *testing.T, factory Factory) {
+	ctx := context.Background()
+	src, _ := factory(t)
+	user := newUser(t)
+	createdAt := time.Now().UTC().Truncate(time.Second)
+
+	keys := []storage.APIKey{
+		{ID: newUser(t), User: user, Name: "ci", Hash: newUser(t), CreatedAt: createdAt},
+		{ID: newUser(t), User: user, Hash: newUser(t), CreatedAt: createdAt.Add(time.Second)},
+	}
+	for _, key := range keys {
+		require.NoError(t, src.AddAPIKey(ctx, key))
+	}
+
+	var exported []storage.APIKey
+	require.NoError(t, src.ExportAPIKeys(ctx, func(key storage.APIKey) error {
+		if key.User == user {
+			exported = append(exported, key)
+		}
+		return nil
+	}))
+	requireAPIKeys(t, keys, exported)
+
+	// new IDs and hashes, as a database backend gives the same data to src and
+	// dst; a key whose hash is taken in dst is skipped
+	dst, reopen := factory(t)
+	taken := storage.APIKey{ID: newUser(t), User: newUser(t), Hash: newUser(t), CreatedAt: createdAt}
+	require.NoError(t, dst.AddAPIKey(ctx, taken))
+	dstUser := newUser(t)
+	for i := range exported {
+		exported[i].ID, exported[i].User, exported[i].Hash = newUser(t), dstUser, newUser(t)
+	}
+	toImport := append(exported, storage.APIKey{ID: newUser(t), User: dstUser, Hash: taken.Hash, CreatedAt: createdAt})
+	require.NoError(t, dst.ImportAPIKeys(ctx, toImport))
+	require.NoError(t, dst.ImportAPIKeys(ctx, toImport), "import of the same keys must be idempotent")
+	if reopen != nil {
+		dst = reopen()
+	}
+
+	list, err := dst.GetAPIKeys(ctx, dstUser)
+	require.NoError(t, err)
+	requireAPIKeys(t, exported, list)
+	user, err = dst.UserByAPIKey(ctx, taken.Hash)
+	require.NoError(t, err)
+	assert.Equal(t, taken.User, user)
+}
+
+// requireAPIKeys compares keys field by field, CreatedAt comes back from
+// storage in its own location.
+func requireAPIKeys(t *testing.T, want []storage.APIKey, got []storage.APIKey) {
+	t.Helper()
+	require.Len(t, got, len(want))
+	for i := range want {
+		assert.Equal(t, want[i].ID, got[i].ID)
+		assert.Equal(t, want[i].User, got[i].User)
+		assert.Equal(t, want[i].Name, got[i].Name)
+		assert.Equal(t, want[i].Hash, got[i].Hash)
+		assert.True(t, want[i].CreatedAt.Equal(got[i].CreatedAt), "%v != %v", want[i].CreatedAt, got[i].CreatedAt)
+	}
+}
+
+func testClose(t *testing.T, factory Factory) {
+	st, reopen := factory(t)
+	ctx := context.Background()
+
+	url := newURL(t)
+	shortURL, err := st.AddURL(ctx, url, newUser(t), time.Time{})
+	require.NoError(t, err)
+
+	require.NoError(t, st.Close())
+	require.NoError(t, st.Close(), "closing twice is not an error")
+
+	if reopen != nil {
+		requireURL(t, reopen(), shortURL, url)
+	}
+}
@@ -0,0 +1,79 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelfSigned(t *testing.T) {
+	for host, names := range map[string][]string{
+		"shortener.local": {"shortener.local"},
+		"127.0.0.1":       {"127.0.0.1"},
+		"::1":             {"::1"},
+		"":                {"localhost", "127.0.0.1", "::1"},
+		"0.0.0.0":         {"localhost", "127.0.0.1", "::1"},
+	} {
+		cert, err := SelfSigned(host, time.Hour)
+		require.NoError(t, err, host)
+
+		roots := x509.NewCertPool()
+		roots.AddCert(cert.Leaf)
+		for _, name := range names {
+			_, err := cert.Leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: roots})
+			assert.NoError(t, err, "%s for %q", name, host)
+		}
+		assert.Error(t, cert.Leaf.VerifyHostname("example.com"), host)
+	}
+}
+
+func TestServeHTTP2(t *testing.T) {
+	cert, err := SelfSigned("127.0.0.1", time.Hour)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0644))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600))
+
+	loaded, err := Load(certFile, keyFile)
+	require.NoError(t, err)
+	_, err = Load(certFile, certFile)
+	assert.Error(t, err)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.EnableHTTP2 = true
+	srv.TLS = New(loaded)
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := client.Get(srv.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.Equal(t, uint16(tls.VersionTLS13), resp.TLS.Version)
+
+	old := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:    roots,
+		MaxVersion: tls.VersionTLS11,
+	}}}
+	_, err = old.Get(srv.URL)
+	assert.Error(t, err, "TLS 1.1 is refused")
+}
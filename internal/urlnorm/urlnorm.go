@@ -0,0 +1,127 @@
+// Package urlnorm checks that URLs given to the service are safe to redirect
+// to and brings the ways to write one URL to a single form, so they are
+// stored once.
+package urlnorm
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// MaxLength is more than browsers and most servers accept in a URL.
+const MaxLength = 8192
+
+var ErrInvalidURL = errors.New("invalid URL")
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// Normalizer turns URLs into their normal form. Scheme and host are always
+// lowercased and hosts are IDNA encoded, the rest is up to the fields; the
+// zero value keeps everything else as given but the default port.
+type Normalizer struct {
+	// KeepDefaultPort leaves :80 of http and :443 of https URLs.
+	KeepDefaultPort bool
+	// StripFragment drops #fragment, it is never sent to the server the
+	// link leads to, but single page applications route by it.
+	StripFragment bool
+	// SortQuery orders query parameters by name, servers rarely depend on
+	// their order, but some do.
+	SortQuery bool
+}
+
+func invalid(format string, a ...interface{}) error {
+	return fmt.Errorf("%w: "+format, append([]interface{}{ErrInvalidURL}, a...)...)
+}
+
+// Normalize validates raw as an absolute http or https URL and returns its
+// normal form. Errors wrap ErrInvalidURL and say what is wrong.
+func (n Normalizer) Normalize(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	switch {
+	case raw == "":
+		return "", invalid("URL is empty")
+	case len(raw) > MaxLength:
+		return "", invalid("URL is longer than %d bytes", MaxLength)
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		// url.Error repeats the whole URL, the reason is enough
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return "", invalid("%v", err)
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	if _, found := defaultPorts[u.Scheme]; !found {
+		return "", invalid("scheme must be http or https")
+	}
+	if u.Opaque != "" || u.Host == "" {
+		return "", invalid("host is missing")
+	}
+	// https://trusted.com@evil.com leads to evil.com
+	if u.User != nil {
+		return "", invalid("credentials in URL are not allowed")
+	}
+
+	host, err := normalizeHost(u.Hostname())
+	if err != nil {
+		return "", err
+	}
+	port := u.Port()
+	if port != "" {
+		if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			return "", invalid("port %q is out of range", port)
+		}
+		if !n.KeepDefaultPort && port == defaultPorts[u.Scheme] {
+			port = ""
+		}
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	u.Host = host
+
+	if n.StripFragment {
+		u.Fragment, u.RawFragment = "", ""
+	}
+	if n.SortQuery && u.RawQuery != "" {
+		// a query that is not name=value pairs, like ?50%, is the server's
+		// business, it is kept as it is
+		if query, err := url.ParseQuery(u.RawQuery); err == nil {
+			// Encode sorts by name and keeps the order of repeated names
+			u.RawQuery = query.Encode()
+		}
+	}
+	return u.String(), nil
+}
+
+func normalizeHost(host string) (string, error) {
+	if host == "" {
+		return "", invalid("host is missing")
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String(), nil
+	}
+	// ToASCII of the lookup profile lowercases and rejects what can not be
+	// a registered name, like spaces and disallowed code points
+	ascii, err := idna.Lookup.ToASCII(strings.TrimSuffix(host, "."))
+	if err != nil {
+		return "", invalid("host %q: %v", host, err)
+	}
+	return ascii, nil
+}
@@ -0,0 +1,61 @@
+package urlnorm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalize(t *testing.T) {
+	for raw, want := range map[string]string{
+		"https://github.com/":                   "https://github.com/",
+		"  HTTPS://GitHub.COM/Path?Q=1  ":       "https://github.com/Path?Q=1",
+		"http://example.com:80/a":               "http://example.com/a",
+		"https://example.com:443":               "https://example.com",
+		"https://example.com:8443/":             "https://example.com:8443/",
+		"http://example.com:443/":               "http://example.com:443/",
+		"https://пример.рф/путь":                "https://xn--e1afmkfd.xn--p1ai/%D0%BF%D1%83%D1%82%D1%8C",
+		"https://Bücher.example./":              "https://xn--bcher-kva.example/",
+		"http://[2001:DB8::1]:80/":              "http://[2001:db8::1]/",
+		"http://127.0.0.1:8080/x":               "http://127.0.0.1:8080/x",
+		"https://example.com/?b=2&a=1#section":  "https://example.com/?b=2&a=1#section",
+		"https://example.com/a%2Fb?q=%20#frag1": "https://example.com/a%2Fb?q=%20#frag1",
+	} {
+		got, err := Normalizer{}.Normalize(raw)
+		if assert.NoError(t, err, raw) {
+			assert.Equal(t, want, got, raw)
+		}
+	}
+
+	n := Normalizer{KeepDefaultPort: true, StripFragment: true, SortQuery: true}
+	got, err := n.Normalize("https://example.com:443/?b=2&a=1&b=1#section")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.com:443/?a=1&b=2&b=1", got)
+
+	got, err = n.Normalize("https://example.com/?b=2&a=%zz")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.com/?b=2&a=%zz", got, "a query that does not parse is kept")
+}
+
+func TestNormalizeRejects(t *testing.T) {
+	for name, raw := range map[string]string{
+		"empty":       "",
+		"spaces":      "   ",
+		"relative":    "/path",
+		"no scheme":   "example.com",
+		"javascript":  "javascript:alert(1)",
+		"data":        "data:text/html,<script>alert(1)</script>",
+		"ftp":         "ftp://example.com/",
+		"opaque":      "http:example.com",
+		"no host":     "https:///path",
+		"credentials": "https://trusted.com@evil.com/",
+		"bad port":    "https://example.com:99999/",
+		"bad host":    "https://exa mple.com/",
+		"bad idna":    "https://xn--a.com/",
+		"newline":     "https://example.com/\nSet-Cookie: a=b",
+		"too long":    "https://example.com/" + string(make([]byte, MaxLength)),
+	} {
+		_, err := Normalizer{}.Normalize(raw)
+		assert.ErrorIs(t, err, ErrInvalidURL, name)
+	}
+}